@@ -0,0 +1,478 @@
+package cbzip2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// bzip2 streams are a 4 byte "BZh1".."BZh9" header followed by bit aligned
+// blocks, each starting with blockMagic and its 32 bit CRC, and terminated
+// by eosMagic, the 32 bit combined CRC and padding to a byte boundary.
+const (
+	blockMagic = 0x314159265359
+	eosMagic   = 0x177245385090
+	magicMask  = 1<<48 - 1
+	magicBits  = 48
+	crcBits    = 32
+	headerLen  = 4
+)
+
+// errNoMagic is returned by nextMagic once it has searched past the longest
+// a block can be without finding a magic number.
+var errNoMagic = errors.New("no magic number found")
+
+// blockSegment is the compressed form of one block, as found by a
+// blockScanner: nbits bits of data starting at bit startBit of data[0],
+// beginning with the block magic.
+type blockSegment struct {
+	data     []byte
+	startBit uint
+	nbits    int64
+	// offset is the absolute bit offset of the block in the input
+	offset int64
+	// level is the block size digit from the stream header
+	level byte
+	// crc is the block CRC stored after the magic
+	crc uint32
+}
+
+// blockScanner splits a sequence of bzip2 streams into blocks without
+// decoding them, by searching for the bit aligned block and end of stream
+// magic numbers. The compressed data of a block may contain a magic number
+// by chance, so a segment may be only part of a block and callers must be
+// prepared to join it to the segment that follows.
+type blockScanner struct {
+	r   io.Reader
+	buf []byte
+	// off is the absolute byte offset of buf[0] in the input
+	off int64
+	// pos is the number of bits of buf searched so far, and reg the last
+	// 64 of them
+	pos int64
+	reg uint64
+	eof bool
+	err error
+	// lenient keeps going past damage, for Recover: a bad stream header
+	// is taken to be level 9, and the input ending inside a stream ends
+	// the scan after returning what there is of the last block.
+	lenient bool
+
+	// level is the header digit of the current stream, 0 between streams
+	level byte
+	// start is the bit position in buf of the current block, -1 if the
+	// stream has no block yet
+	start int64
+	// cand is the bit position in buf of an end of stream magic that was
+	// not followed by another stream, -1 if there is none. It is the end
+	// of the input's last stream if no magic follows it, see trailing.
+	cand int64
+	// garbage is set once trailing has ended the last stream
+	garbage bool
+	// eos is the end of the stream whose last block was just returned
+	eos *scanEvent
+}
+
+func newBlockScanner(r io.Reader) *blockScanner {
+	return &blockScanner{r: r, buf: make([]byte, 0, bufferLen)}
+}
+
+// scanEvent is a block, or the end of a stream.
+type scanEvent struct {
+	// block is set for a block, nil for the end of a stream
+	block *blockSegment
+	// for the end of a stream, the stored combined CRC and the absolute
+	// bit offset of the end of stream marker
+	streamCRC uint32
+	offset    int64
+}
+
+// next returns the next block or end of stream in the input. It returns
+// io.EOF once every stream has been scanned, and io.ErrUnexpectedEOF if
+// the input ends inside a stream.
+func (s *blockScanner) next() (*scanEvent, error) {
+	if ev := s.eos; ev != nil {
+		s.eos = nil
+		return ev, nil
+	}
+	if s.level == 0 {
+		if s.garbage {
+			if s.lenient {
+				return nil, io.EOF
+			}
+			return nil, ErrBadMagic
+		}
+		level, err := s.header()
+		if err == io.ErrUnexpectedEOF && s.lenient {
+			// a few stray bytes at the end
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.level = level
+		s.start = -1
+		s.cand = -1
+		s.pos = 8 * headerLen
+		s.reg = 0
+	}
+	for {
+		kind, at, err := s.nextMagic()
+		if err == errNoMagic || err == io.ErrUnexpectedEOF && s.cand >= 0 {
+			return s.trailing()
+		}
+		if err == io.ErrUnexpectedEOF && s.lenient {
+			return s.truncated(8 * int64(len(s.buf)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if kind == eosMagic {
+			ev, ok, err := s.endOfStream(at)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// the magic number was part of the block data
+				continue
+			}
+			return ev, nil
+		}
+		// a block magic after cand shows it was part of the block data
+		s.cand = -1
+		if s.start < 0 {
+			s.start = at
+			continue
+		}
+		return &scanEvent{block: s.cut(at)}, nil
+	}
+}
+
+// header reads the stream header at the start of buf.
+func (s *blockScanner) header() (byte, error) {
+	if err := s.need(headerLen); err != nil {
+		if err == io.ErrUnexpectedEOF && len(s.buf) == 0 {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	if !bytes.Equal(s.buf[:3], []byte("BZh")) || s.buf[3] < '1' || s.buf[3] > '9' {
+		if s.lenient {
+			// any block can be decoded at the largest block size
+			return '9', nil
+		}
+		return 0, ErrBadMagic
+	}
+	return s.buf[3], nil
+}
+
+// nextMagic searches buf bit by bit for the next magic number, returning
+// which one was found and the bit position of its first bit.
+func (s *blockScanner) nextMagic() (uint64, int64, error) {
+	for {
+		// finish a byte left part way through a bit at a time
+		for ; s.pos%8 != 0 && s.pos < 8*int64(len(s.buf)); s.pos++ {
+			bit := s.buf[s.pos/8] >> (7 - uint(s.pos%8)) & 1
+			s.reg = s.reg<<1 | uint64(bit)
+			if magic, ok := s.magicAt(s.reg, s.pos+1); ok {
+				s.pos++
+				return magic, s.pos - magicBits, nil
+			}
+		}
+		// then a byte at a time, checking the positions a magic could end
+		// at in each, as found from the byte two before it
+		reg := s.reg
+		for i := s.pos / 8; i < int64(len(s.buf)); i++ {
+			reg = reg<<8 | uint64(s.buf[i])
+			shifts := magicShifts[byte(reg>>16)]
+			if shifts == 0 {
+				continue
+			}
+			for k := 7; k >= 0; k-- {
+				if shifts&(1<<k) == 0 {
+					continue
+				}
+				if magic, ok := s.magicAt(reg>>k, 8*i+8-int64(k)); ok {
+					s.reg = reg >> k
+					s.pos = 8*i + 8 - int64(k)
+					return magic, s.pos - magicBits, nil
+				}
+			}
+		}
+		s.reg, s.pos = reg, 8*int64(len(s.buf))
+		if s.cand >= 0 && s.start >= 0 {
+			// past the longest a block can be, cand can't have been part
+			// of it
+			if bits, _ := blockLimits(s.level); s.pos-s.start > bits {
+				return 0, 0, errNoMagic
+			}
+		}
+		if err := s.fill(); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// magicShifts has bit k of entry b set if a magic number ending k bits
+// before the end of a byte has b as the byte two before that one, bits
+// 24+k to 32+k of the magic. Any other byte rules out a magic ending there.
+var magicShifts = func() (t [256]uint8) {
+	for k := 0; k < 8; k++ {
+		for _, m := range []uint64{blockMagic, eosMagic} {
+			t[byte(m>>(16-k))] |= 1 << k
+		}
+	}
+	return t
+}()
+
+// magicAt reports which magic number, if any, ends reg, whose last bit is
+// the one before bit end of buf. Only those after the header are
+// considered.
+func (s *blockScanner) magicAt(reg uint64, end int64) (uint64, bool) {
+	switch reg & magicMask {
+	case blockMagic, eosMagic:
+		return reg & magicMask, end-magicBits >= 8*headerLen
+	}
+	return 0, false
+}
+
+// endOfStream checks that the end of stream magic at bit at is followed
+// by the end of the input or another stream, and if so moves on to it.
+// If the stream had any blocks, the last of them is returned and the end
+// of stream is held back for the next call to next.
+func (s *blockScanner) endOfStream(at int64) (*scanEvent, bool, error) {
+	end := (at + magicBits + crcBits + 7) / 8
+	if err := s.need(int(end)); err != nil {
+		if err == io.ErrUnexpectedEOF && s.lenient {
+			// only the trailer is cut short
+			ev, err := s.truncated(at)
+			return ev, true, err
+		}
+		return nil, false, err
+	}
+	// peek at what follows, without it being an error if it is missing
+	if err := s.need(int(end) + 3); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	if rest := s.buf[end:]; len(rest) > 0 && !bytes.HasPrefix([]byte("BZh"), rest[:min(len(rest), 3)]) {
+		s.cand = at
+		return nil, false, nil
+	}
+	ev, last := s.endStream(at)
+	if last != nil {
+		s.eos = ev
+		return last, true, nil
+	}
+	return ev, true, nil
+}
+
+// trailing ends the last stream at the end of stream magic at cand, now
+// that no magic number follows to show it was part of the block data,
+// and leaves what follows it as trailing garbage.
+func (s *blockScanner) trailing() (*scanEvent, error) {
+	ev, last := s.endStream(s.cand)
+	s.garbage = true
+	if last != nil {
+		s.eos = ev
+		return last, nil
+	}
+	return ev, nil
+}
+
+// endStream ends the stream at the end of stream magic at bit at, and
+// returns the end of stream and, if the stream had any blocks, the last of
+// them.
+func (s *blockScanner) endStream(at int64) (ev, last *scanEvent) {
+	end := (at + magicBits + crcBits + 7) / 8
+	ev = &scanEvent{
+		streamCRC: uint32(readBits(s.buf, at+magicBits, crcBits)),
+		offset:    8*s.off + at,
+	}
+	end += s.off
+	if s.start >= 0 {
+		last = &scanEvent{block: s.cut(at)}
+	}
+	s.discard(int(end - s.off))
+	s.level = 0
+	s.cand = -1
+	return ev, last
+}
+
+// truncated returns the last block of a stream cut short by the end of the
+// input, which ends at bit at, or io.EOF if there is none.
+func (s *blockScanner) truncated(at int64) (*scanEvent, error) {
+	if s.start < 0 {
+		return nil, io.EOF
+	}
+	seg := s.cut(at)
+	s.start = -1
+	return &scanEvent{block: seg}, nil
+}
+
+// cut returns the block from s.start up to bit at, which becomes the start
+// of the next one. The returned segment does not share memory with buf.
+func (s *blockScanner) cut(at int64) *blockSegment {
+	seg := &blockSegment{
+		data:     s.buf[s.start/8 : (at+7)/8],
+		startBit: uint(s.start % 8),
+		nbits:    at - s.start,
+		offset:   8*s.off + s.start,
+		level:    s.level,
+	}
+	if seg.nbits >= magicBits+crcBits {
+		seg.crc = uint32(readBits(s.buf, s.start+magicBits, crcBits))
+	}
+	s.start = at
+	s.discard(int(at / 8))
+	return seg
+}
+
+// discard drops the first n bytes of buf. The remainder is copied so that
+// segments already handed out are never overwritten.
+func (s *blockScanner) discard(n int) {
+	buf := make([]byte, len(s.buf)-n, max(cap(s.buf), bufferLen))
+	copy(buf, s.buf[n:])
+	s.buf = buf
+	s.off += int64(n)
+	s.pos -= 8 * int64(n)
+	if s.start >= 0 {
+		s.start -= 8 * int64(n)
+	}
+	if s.cand >= 0 {
+		s.cand -= 8 * int64(n)
+	}
+}
+
+// need reads until buf holds at least n bytes.
+func (s *blockScanner) need(n int) error {
+	for len(s.buf) < n {
+		if err := s.fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill appends more of the input to buf.
+func (s *blockScanner) fill() error {
+	if s.err != nil {
+		return s.err
+	}
+	if cap(s.buf)-len(s.buf) < bufferLen {
+		s.buf = grow(s.buf, bufferLen)
+	}
+	n, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+	s.buf = s.buf[:len(s.buf)+n]
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if n == 0 && err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// readBits returns the n <= 64 bits of b starting at bit pos.
+func readBits(b []byte, pos int64, n uint) uint64 {
+	var v uint64
+	for i := int64(0); i < int64(n); i++ {
+		bit := b[(pos+i)/8] >> (7 - uint((pos+i)%8)) & 1
+		v = v<<1 | uint64(bit)
+	}
+	return v
+}
+
+// bitWriter builds a bzip2 stream a few bits at a time.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+// writeBits appends the low n <= 32 bits of v.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	w.acc = w.acc<<n | v&(1<<n-1)
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.nacc -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nacc))
+	}
+}
+
+// writeSegment appends the bits of seg.
+func (w *bitWriter) writeSegment(seg *blockSegment) {
+	full := seg.nbits / 8
+	if seg.startBit == 0 && w.nacc == 0 {
+		w.buf = append(w.buf, seg.data[:full]...)
+	} else {
+		for i := int64(0); i < full; i++ {
+			b := uint(seg.data[i])<<8 | uint(seg.data[min(i+1, int64(len(seg.data)-1))])
+			w.writeBits(uint64(b>>(8-seg.startBit)), 8)
+		}
+	}
+	if rem := uint(seg.nbits % 8); rem > 0 {
+		w.writeBits(readBits(seg.data, int64(seg.startBit)+8*full, rem), rem)
+	}
+}
+
+// bytes pads the stream to a byte boundary and returns it.
+func (w *bitWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.writeBits(0, 8-w.nacc)
+	}
+	return w.buf
+}
+
+// singleBlockStream wraps the (possibly split) block in segs in a stream
+// header and trailer, so that it can be decoded on its own.
+func singleBlockStream(segs ...*blockSegment) []byte {
+	var n int64
+	for _, seg := range segs {
+		n += seg.nbits
+	}
+	w := &bitWriter{buf: make([]byte, 0, headerLen+n/8+12)}
+	w.buf = append(w.buf, 'B', 'Z', 'h', segs[0].level)
+	for _, seg := range segs {
+		w.writeSegment(seg)
+	}
+	w.writeBits(eosMagic>>24, 24)
+	w.writeBits(eosMagic&(1<<24-1), 24)
+	// the combined CRC of a single block stream is the block's CRC
+	w.writeBits(uint64(segs[0].crc), crcBits)
+	return w.bytes()
+}
+
+// decodeBlock decompresses the block made up of segs, which verifies its
+// CRC. opts, if not nil, sets how the block is decoded, as for a Reader.
+func decodeBlock(opts *ReaderOptions, segs ...*blockSegment) ([]byte, error) {
+	return decompressOptions(nil, singleBlockStream(segs...), 0, opts)
+}
+
+// placeError moves an *Error from decoding a block on its own to where
+// the block is in the whole input: block number n, starting at bit offset
+// in and byte offset out.
+func placeError(err error, n int, in, out int64) error {
+	if e, ok := err.(*Error); ok && e.Block > 0 {
+		e.Block = n
+		e.CompressedOffset, e.UncompressedOffset = in/8, out
+	}
+	return err
+}
+
+// estimateLost guesses how much data the block starting with seg held, when
+// it can't be decoded, from how well the out bytes decoded so far from
+// inBits bits of input compressed. A block can't be much larger than its
+// block size.
+func estimateLost(seg *blockSegment, out, inBits int64) int64 {
+	lost := int64(seg.level-'0') * 100000
+	if inBits > 0 {
+		lost = min(lost, seg.nbits*out/inBits)
+	}
+	return lost
+}
+
+// combineCRC folds a block CRC into a stream's combined CRC.
+func combineCRC(combined, block uint32) uint32 {
+	return (combined<<1 | combined>>31) ^ block
+}
@@ -0,0 +1,108 @@
+package cbzip2
+
+import "io"
+
+// Compress appends the bzip2 compressed form of src to dst and returns the
+// extended buffer. It is the one-shot equivalent of writing src to a Writer
+// and closing it, without the intermediate buffering. A nil opts uses the
+// defaults.
+func Compress(dst, src []byte, opts *WriterOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return dst, err
+	}
+	var bz bzip
+	if err := bz.compressInit(opts.blockSize(), opts.Verbosity, opts.workFactor(), newStreamHooks(opts.Log, nil), opts.MemoryBudget); err != nil {
+		return dst, err
+	}
+	defer bz.endCompress()
+
+	start := len(dst)
+	// bzip2 output is at most 1% larger than its input, plus headers
+	dst = grow(dst, len(src)+len(src)/100+600)
+	bz.setInBuf(src, len(src))
+	for {
+		if len(dst) == cap(dst) {
+			dst = grow(dst, bufferLen)
+		}
+		free := dst[len(dst):cap(dst)]
+		bz.setOutBuf(free, len(free))
+		ret, err := bz.compress(BZ_FINISH)
+		if err != nil {
+			return dst[:start], err
+		}
+		dst = dst[:len(dst)+len(free)-bz.availOut()]
+		if ret == BZ_STREAM_END {
+			return dst, nil
+		}
+	}
+}
+
+// Decompress appends the decompressed form of the bzip2 stream in src to
+// dst and returns the extended buffer. Only the first stream in src is
+// decoded. If src ends before the end of stream marker, io.ErrUnexpectedEOF
+// is returned.
+func Decompress(dst, src []byte) ([]byte, error) {
+	return DecompressLimit(dst, src, 0)
+}
+
+// DecompressLimit is like Decompress but fails with ErrOutFull rather than
+// produce more than limit bytes of output. A limit of 0 means no limit.
+func DecompressLimit(dst, src []byte, limit int) ([]byte, error) {
+	return decompressOptions(dst, src, limit, nil)
+}
+
+// decompressOptions is DecompressLimit, decoding with the Small,
+// Verbosity, Log and MemoryBudget of opts if it isn't nil.
+func decompressOptions(dst, src []byte, limit int, opts *ReaderOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
+	var bz bzip
+	if err := bz.decompressInit(opts.Verbosity, boolToInt(opts.Small), newStreamHooks(opts.Log, nil), opts.MemoryBudget); err != nil {
+		return dst, err
+	}
+	defer bz.endDecompress()
+
+	start := len(dst)
+	bz.setInBuf(src, len(src))
+	for {
+		var free []byte
+		if limit <= 0 || len(dst)-start < limit {
+			if len(dst) == cap(dst) {
+				// guess at a 4x expansion to start with
+				dst = grow(dst, 4*len(src)+bufferLen)
+			}
+			free = dst[len(dst):cap(dst)]
+			if limit > 0 && len(free) > limit-(len(dst)-start) {
+				free = free[:limit-(len(dst)-start)]
+			}
+		}
+		bz.setOutBuf(free, len(free))
+		ret, err := bz.decompress()
+		if err != nil {
+			return dst[:start], err
+		}
+		dst = dst[:len(dst)+len(free)-bz.availOut()]
+		switch {
+		case ret == BZ_STREAM_END:
+			return dst, nil
+		case len(free) == 0:
+			// we are at the limit, and there is more output to come
+			return dst[:start], ErrOutFull
+		case bz.availOut() > 0 && bz.availIn() == 0:
+			// the decompressor is starved of input
+			return dst[:start], io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// grow returns b with room for at least n more bytes.
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	return append(b[:cap(b)], make([]byte, n)...)[:len(b)]
+}
@@ -0,0 +1,70 @@
+package cbzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/rand"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestBufferRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 1024, 100 * 1024, 1025 * 1025}
+	for _, v := range sizes {
+		t.Logf("round tripping buffer of len: %d", v)
+		raw := make([]byte, v)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			t.Fatalf("error generating random data: %s", err)
+		}
+		prefix := []byte("prefix")
+		compressed, err := Compress(append([]byte{}, prefix...), raw, nil)
+		if err != nil {
+			t.Fatalf("error compressing data: %s", err)
+		}
+		if !bytes.HasPrefix(compressed, prefix) {
+			t.Fatal("Compress did not append to dst")
+		}
+		compressed = compressed[len(prefix):]
+
+		var goDecomp bytes.Buffer
+		if _, err := io.Copy(&goDecomp, bzip2.NewReader(bytes.NewReader(compressed))); err != nil {
+			t.Fatalf("error decompressing with go: %s", err)
+		}
+		if !reflect.DeepEqual(raw, goDecomp.Bytes()) {
+			t.Fatal("go decompressed data does not match")
+		}
+
+		decompressed, err := Decompress(append([]byte{}, prefix...), compressed)
+		if err != nil {
+			t.Fatalf("error decompressing data: %s", err)
+		}
+		if !bytes.Equal(raw, decompressed[len(prefix):]) || !bytes.HasPrefix(decompressed, prefix) {
+			t.Fatal("data passed through Compress and Decompress did not match")
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	raw := bytes.Repeat([]byte("a"), 1024*1024)
+	compressed, err := Compress(nil, raw, &WriterOptions{BlockSize: BestSpeed})
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	out, err := DecompressLimit(nil, compressed, len(raw))
+	if err != nil {
+		t.Fatalf("error decompressing data at exactly the limit: %s", err)
+	}
+	if !bytes.Equal(raw, out) {
+		t.Fatal("data decompressed at the limit did not match")
+	}
+	if _, err := DecompressLimit(nil, compressed, len(raw)-1); err != ErrOutFull {
+		t.Fatalf("wanted err: %v, got: %v", ErrOutFull, err)
+	}
+	if _, err := Decompress(nil, compressed[:len(compressed)/2]); err != io.ErrUnexpectedEOF {
+		t.Fatalf("wanted err: %v, got: %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := Compress(nil, raw, &WriterOptions{BlockSize: 10}); err != ErrBlockSize {
+		t.Fatalf("wanted err: %v, got: %v", ErrBlockSize, err)
+	}
+}
@@ -40,6 +40,10 @@
 #ifndef BZ_NO_STDIO
 void BZ2_bz__AssertH__fail ( int errcode )
 {
+   /*-- cbzip2: unwind back to the Go caller if it is guarding
+        this call, rather than taking the whole process down. --*/
+   BZ2_bz__AssertH__recover ( errcode );
+
    fprintf(stderr, 
       "\n\nbzip2/libbzip2: internal error number %d.\n"
       "This is a bug in bzip2/libbzip2, %s.\n"
@@ -523,6 +527,8 @@ int BZ_API(BZ2_bzDecompressInit)
    s->tt                    = NULL;
    s->currBlockNo           = 0;
    s->verbosity             = verbosity;
+   s->blockStartIn          = 0;
+   s->blockStartOut         = 0;
 
    return BZ_OK;
 }
@@ -829,6 +835,7 @@ int BZ_API(BZ2_bzDecompress) ( bz_stream *strm )
             if (s->verbosity >= 2) VPrintf0 ( "]" );
             if (s->calculatedBlockCRC != s->storedBlockCRC)
                return BZ_DATA_ERROR;
+            BZ2_bz__DecodeEvent ( s, BZ_EVENT_BLOCK_DONE );
             s->calculatedCombinedCRC 
                = (s->calculatedCombinedCRC << 1) | 
                     (s->calculatedCombinedCRC >> 31);
@@ -56,6 +56,7 @@ typedef unsigned short  UInt16;
 #ifndef BZ_NO_STDIO
 
 extern void BZ2_bz__AssertH__fail ( int errcode );
+extern void BZ2_bz__AssertH__recover ( int errcode );
 #define AssertH(cond,errcode) \
    { if (!(cond)) BZ2_bz__AssertH__fail ( errcode ); }
 
@@ -70,18 +71,21 @@ extern void BZ2_bz__AssertH__fail ( int errcode );
 #define AssertD(cond,msg) /* */
 #endif
 
+/*-- cbzip2: diagnostics are routed through hooks.c so that they
+     can be delivered to the Go side of the stream that produced them. --*/
+extern void BZ2_bz__VPrintf ( const char* fmt, ... );
 #define VPrintf0(zf) \
-   fprintf(stderr,zf)
+   BZ2_bz__VPrintf(zf)
 #define VPrintf1(zf,za1) \
-   fprintf(stderr,zf,za1)
+   BZ2_bz__VPrintf(zf,za1)
 #define VPrintf2(zf,za1,za2) \
-   fprintf(stderr,zf,za1,za2)
+   BZ2_bz__VPrintf(zf,za1,za2)
 #define VPrintf3(zf,za1,za2,za3) \
-   fprintf(stderr,zf,za1,za2,za3)
+   BZ2_bz__VPrintf(zf,za1,za2,za3)
 #define VPrintf4(zf,za1,za2,za3,za4) \
-   fprintf(stderr,zf,za1,za2,za3,za4)
+   BZ2_bz__VPrintf(zf,za1,za2,za3,za4)
 #define VPrintf5(zf,za1,za2,za3,za4,za5) \
-   fprintf(stderr,zf,za1,za2,za3,za4,za5)
+   BZ2_bz__VPrintf(zf,za1,za2,za3,za4,za5)
 
 #else
 
@@ -284,6 +288,13 @@ BZ2_hbAssignCodes ( Int32*, UChar*, Int32, Int32, Int32 );
 extern void 
 BZ2_hbMakeCodeLengths ( UChar*, Int32*, Int32, Int32 );
 
+/*-- cbzip2: block boundaries written by the compressor, reported to
+     the Go side of the stream through hooks.c, using the BZ_EVENT_BLOCK
+     and BZ_EVENT_STREAM_END codes defined below. --*/
+
+extern void
+BZ2_bz__CompressEvent ( EState*, Int32 );
+
 
 
 /*-- states for decompression. --*/
@@ -368,6 +379,11 @@ typedef
       Int32    currBlockNo;
       Int32    verbosity;
 
+      /* cbzip2: where the current block starts, as a bit offset in the
+         input and a byte offset in the output, for error reports */
+      unsigned long long blockStartIn;
+      unsigned long long blockStartOut;
+
       /* for undoing the Burrows-Wheeler transform */
       Int32    origPtr;
       UInt32   tPos;
@@ -491,6 +507,16 @@ extern void
 BZ2_hbCreateDecodeTables ( Int32*, Int32*, Int32*, UChar*,
                            Int32,  Int32, Int32 );
 
+/*-- cbzip2: block boundaries seen by the decompressor, reported to
+     the Go side of the stream through hooks.c. --*/
+
+#define BZ_EVENT_BLOCK      0  /* a block magic has been read */
+#define BZ_EVENT_BLOCK_DONE 1  /* a block's output passed its CRC check */
+#define BZ_EVENT_STREAM_END 2  /* the end of stream magic has been read */
+
+extern void
+BZ2_bz__DecodeEvent ( DState*, Int32 );
+
 
 #endif
 
@@ -3,118 +3,425 @@ package cbzip2
 /*
 #cgo CFLAGS: -Werror=implicit
 
+#include <stdint.h>
+#include <stdlib.h>
+
 #include "bzlib.h"
+#include "hooks.h"
+
+// stream_set_ctx gives strm a new bz_stream_ctx, returning 0 if there is
+// no memory for it.
+int stream_set_ctx(bz_stream *strm, uintptr_t handle, int log, long long budget) {
+	bz_stream_ctx* ctx = bz_ctx_new(handle, log, budget);
+	if (ctx == NULL) {
+		return 0;
+	}
+	strm->bzalloc = bz_ctx_alloc;
+	strm->bzfree = bz_ctx_free;
+	strm->opaque = ctx;
+	return 1;
+}
+
+// stream_free_ctx releases the bz_stream_ctx of strm, once libbzip2 is
+// done with it.
+void stream_free_ctx(bz_stream *strm) {
+	free(strm->opaque);
+	strm->opaque = NULL;
+}
+
+int bz_compress_init(bz_stream *strm, int blockSize, int verbosity, int workFactor, uintptr_t handle, int log, long long budget) {
+	int ret;
+	if (!stream_set_ctx(strm, handle, log, budget)) {
+		return BZ_MEM_ERROR;
+	}
+	ret = BZ2_bzCompressInit(strm, blockSize, verbosity, workFactor);
+	if (ret != BZ_OK) {
+		stream_free_ctx(strm);
+	}
+	return ret;
+}
+
+int bz_decompress_init(bz_stream *strm, int verbosity, int small, uintptr_t handle, int log, long long budget) {
+	int ret;
+	if (!stream_set_ctx(strm, handle, log, budget)) {
+		return BZ_MEM_ERROR;
+	}
+	ret = BZ2_bzDecompressInit(strm, verbosity, small);
+	if (ret != BZ_OK) {
+		stream_free_ctx(strm);
+	}
+	return ret;
+}
 
-int bz_compress_init(char *strm, int blockSize, int verbosity, int workFactor) {
-	((bz_stream*)strm)->bzalloc = NULL;
-	((bz_stream*)strm)->bzfree = NULL;
-	((bz_stream*)strm)->opaque = NULL;
-	return BZ2_bzCompressInit((bz_stream*)strm,
-	                           blockSize, verbosity, workFactor);
+// stream_decompress_restart readies strm for the next of several
+// concatenated streams, keeping the hooks.
+int stream_decompress_restart(bz_stream *strm, int verbosity, int small) {
+	BZ2_bzDecompressEnd(strm);
+	return BZ2_bzDecompressInit(strm, verbosity, small);
 }
 
-int bz_decompress_init(char *strm, int verbosity, int small) {
-	((bz_stream*)strm)->bzalloc = NULL;
-	((bz_stream*)strm)->bzfree = NULL;
-	((bz_stream*)strm)->opaque = NULL;
-	return BZ2_bzDecompressInit((bz_stream*)strm,
-	                           verbosity, small);
+uintptr_t stream_handle(bz_stream *strm) {
+	bz_stream_ctx* ctx = strm->opaque;
+	return ctx == NULL ? 0 : ctx->handle;
+}
+
+void stream_clear_handle(bz_stream *strm) {
+	bz_stream_ctx* ctx = strm->opaque;
+	if (ctx != NULL) {
+		ctx->handle = 0;
+	}
 }
 
-unsigned int stream_avail_in(char *strm) {
-	return ((bz_stream*)strm)->avail_in;
+long long stream_memory(bz_stream *strm) {
+	bz_stream_ctx* ctx = strm->opaque;
+	return ctx == NULL ? 0 : ctx->used;
 }
 
-unsigned int stream_avail_out(char *strm) {
-	return ((bz_stream*)strm)->avail_out;
+unsigned long long stream_total_in(bz_stream *strm) {
+	return ((unsigned long long)strm->total_in_hi32 << 32) | strm->total_in_lo32;
 }
 
-void stream_set_in_buf(char *strm, char *buf, unsigned int len) {
-	((bz_stream*)strm)->next_in = buf;
-	((bz_stream*)strm)->avail_in = len;
+unsigned long long stream_total_out(bz_stream *strm) {
+	return ((unsigned long long)strm->total_out_hi32 << 32) | strm->total_out_lo32;
 }
 
-void stream_set_out_buf(char *strm, char *buf, unsigned int len) {
-	((bz_stream*)strm)->next_out = buf;
-	((bz_stream*)strm)->avail_out = len;
+// stream_set_bufs hands libbzip2 the buffers for a single call. They are
+// Go memory, which C must not keep once the call returns, so
+// stream_clear_bufs drops them again, leaving only the counts of what is
+// left in them.
+void stream_set_bufs(bz_stream *strm, char *in, unsigned int in_len, char *out, unsigned int out_len) {
+	strm->next_in = in;
+	strm->avail_in = in_len;
+	strm->next_out = out;
+	strm->avail_out = out_len;
 }
 
-int stream_compress(char *strm, int flag) {
-	return BZ2_bzCompress((bz_stream*)strm, flag);
+void stream_clear_bufs(bz_stream *strm) {
+	strm->next_in = NULL;
+	strm->next_out = NULL;
 }
 
-int stream_decompress(char *strm) {
-	return BZ2_bzDecompress((bz_stream*)strm);
+int stream_compress(bz_stream *strm, char *in, unsigned int in_len, char *out, unsigned int out_len, int flag, int *internal) {
+	int ret;
+	stream_set_bufs(strm, in, in_len, out, out_len);
+	ret = bz_hooked_compress(strm, flag, internal);
+	stream_clear_bufs(strm);
+	return ret;
 }
 
-int stream_compress_end(char *strm) {
-	return BZ2_bzCompressEnd((bz_stream*)strm);
+int stream_decompress(bz_stream *strm, char *in, unsigned int in_len, char *out, unsigned int out_len, int *internal) {
+	int ret;
+	stream_set_bufs(strm, in, in_len, out, out_len);
+	ret = bz_hooked_decompress(strm, internal);
+	stream_clear_bufs(strm);
+	return ret;
 }
 
-int stream_decompress_end(char *strm) {
-	return BZ2_bzDecompressEnd((bz_stream*)strm);
+int stream_compress_end(bz_stream *strm) {
+	int ret = BZ2_bzCompressEnd(strm);
+	stream_free_ctx(strm);
+	return ret;
+}
+
+int stream_decompress_end(bz_stream *strm) {
+	int ret = BZ2_bzDecompressEnd(strm);
+	stream_free_ctx(strm);
+	return ret;
 }
 */
 import "C"
-import "unsafe"
+import (
+	"math"
+	"runtime/cgo"
+	"unsafe"
+)
 
-type bzip [unsafe.Sizeof(C.bz_stream{})]C.char
+// bzip is a bz_stream, which lives in C memory so that libbzip2 can keep
+// pointers into it. The buffers are Go memory, only handed to libbzip2
+// for the duration of each compress or decompress call.
+type bzip struct {
+	strm *C.bz_stream
+	// in is the input not yet consumed, and out the space left for output
+	in  []byte
+	out []byte
+	// doneIn and doneOut keep the totals of the stream once it has ended
+	doneIn  int64
+	doneOut int64
+}
 
-func (b *bzip) compressInit(blockSize, verbosity, workFactor int) error {
-	if result := C.bz_compress_init(&b[0], C.int(blockSize), C.int(verbosity), C.int(workFactor)); result != BZ_OK {
-		return retCodeToErr(int(result))
+// alloc allocates the C side of the stream, if it hasn't been already.
+func (b *bzip) alloc() error {
+	b.in, b.out = nil, nil
+	b.doneIn, b.doneOut = 0, 0
+	if b.strm == nil {
+		b.strm = (*C.bz_stream)(C.calloc(1, C.sizeof_bz_stream))
+		if b.strm == nil {
+			return initError(BZ_MEM_ERROR)
+		}
 	}
 	return nil
 }
 
-func (b *bzip) decompressInit(verbosity, small int) error {
-	if result := C.bz_decompress_init(&b[0], C.int(verbosity), C.int(small)); result != BZ_OK {
-		return retCodeToErr(int(result))
+// active reports whether the stream has been initialized and not ended.
+func (b *bzip) active() bool {
+	return b.strm != nil
+}
+
+// free releases the C side of the stream, once libbzip2 is done with it.
+func (b *bzip) free() {
+	b.doneIn, b.doneOut = b.totalIn(), b.totalOut()
+	C.free(unsafe.Pointer(b.strm))
+	b.strm = nil
+	b.in, b.out = nil, nil
+}
+
+// compressInit sets up the stream for compression. budget is the most
+// memory libbzip2 may allocate for it, 0 for no limit.
+func (b *bzip) compressInit(blockSize, verbosity, workFactor int, hooks *streamHooks, budget int64) error {
+	if err := b.alloc(); err != nil {
+		return err
+	}
+	handle := newHandle(hooks)
+	if result := C.bz_compress_init(b.strm, C.int(blockSize), C.int(verbosity), C.int(workFactor), handle, C.int(boolToInt(hooks.logs())), C.longlong(budget)); result != BZ_OK {
+		deleteHandle(handle)
+		b.free()
+		return initError(result)
 	}
 	return nil
 }
 
+// decompressInit sets up the stream for decompression. budget is the most
+// memory libbzip2 may allocate for it, 0 for no limit.
+func (b *bzip) decompressInit(verbosity, small int, hooks *streamHooks, budget int64) error {
+	if err := b.alloc(); err != nil {
+		return err
+	}
+	handle := newHandle(hooks)
+	if result := C.bz_decompress_init(b.strm, C.int(verbosity), C.int(small), handle, C.int(boolToInt(hooks.logs())), C.longlong(budget)); result != BZ_OK {
+		deleteHandle(handle)
+		b.free()
+		return initError(result)
+	}
+	return nil
+}
+
+func (b *bzip) restartDecompress(verbosity, small int) error {
+	if result := C.stream_decompress_restart(b.strm, C.int(verbosity), C.int(small)); result != BZ_OK {
+		return initError(result)
+	}
+	return nil
+}
+
+// initError wraps a failure to set up a stream.
+func initError(ret C.int) error {
+	return &Error{Op: opInit, Code: int(ret), Err: retCodeToErr(int(ret))}
+}
+
+// compressError describes a failed compress call, internal is the
+// assertion number if ret is bzInternalError.
+func (b *bzip) compressError(ret, internal C.int) error {
+	var info C.bz_stream_info
+	C.bz_compress_info(b.strm, &info)
+	return &Error{
+		Op:                 opCompress,
+		Code:               int(ret),
+		Block:              int(info.block),
+		CompressedOffset:   b.totalOut(),
+		UncompressedOffset: b.totalIn(),
+		Err:                codeToErr(ret, internal),
+	}
+}
+
+// decompressError describes a failed decompress call, internal is the
+// assertion number if ret is bzInternalError.
+func (b *bzip) decompressError(ret, internal C.int) error {
+	var info C.bz_stream_info
+	C.bz_decompress_info(b.strm, &info)
+	e := &Error{
+		Op:                 opDecompress,
+		Code:               int(ret),
+		Block:              int(info.block),
+		CompressedOffset:   int64(info.block_start_in / 8),
+		UncompressedOffset: int64(info.block_start_out),
+		Err:                codeToErr(ret, internal),
+	}
+	switch info.crc {
+	case C.BZ_CRC_COMBINED:
+		e.Block = 0
+		fallthrough
+	case C.BZ_CRC_BLOCK:
+		e.StoredCRC, e.ComputedCRC = uint32(info.stored_crc), uint32(info.computed_crc)
+	}
+	if ret == BZ_DATA_ERROR_MAGIC || e.Block == 0 {
+		// not about a block, or about the end of the stream
+		e.Block = 0
+		e.CompressedOffset, e.UncompressedOffset = b.totalIn(), b.totalOut()
+	}
+	return e
+}
+
+// blocks returns the number of blocks the decompressor has started.
+func (b *bzip) blocks() int {
+	if b.strm == nil {
+		return 0
+	}
+	var info C.bz_stream_info
+	C.bz_decompress_info(b.strm, &info)
+	return int(info.block)
+}
+
+func codeToErr(ret, internal C.int) error {
+	if ret == bzInternalError {
+		return &InternalError{Code: int(internal)}
+	}
+	return retCodeToErr(int(ret))
+}
+
+// newHandle returns the handle stored in the bz_stream_ctx of the stream,
+// 0 if there are no hooks.
+func newHandle(hooks *streamHooks) C.uintptr_t {
+	if hooks == nil {
+		return 0
+	}
+	return C.uintptr_t(cgo.NewHandle(hooks))
+}
+
+// deleteHandle frees a handle returned by newHandle.
+func deleteHandle(handle C.uintptr_t) {
+	if handle != 0 {
+		cgo.Handle(handle).Delete()
+	}
+}
+
+// releaseHooks frees the handle stored in the bz_stream_ctx, if any.
+func (b *bzip) releaseHooks() {
+	deleteHandle(C.stream_handle(b.strm))
+	C.stream_clear_handle(b.strm)
+}
+
+// memory is the number of bytes libbzip2 has allocated for the stream.
+func (b *bzip) memory() int64 {
+	if b.strm == nil {
+		return 0
+	}
+	return int64(C.stream_memory(b.strm))
+}
+
 func (b *bzip) availIn() int {
-	return int(C.stream_avail_in(&b[0]))
+	return len(b.in)
 }
 
 func (b *bzip) setInBuf(buf []byte, size int) {
-	if buf == nil || len(buf) == 0 {
-		C.stream_set_in_buf(&b[0], nil, C.uint(size))
-	} else {
-		C.stream_set_in_buf(&b[0], (*C.char)(unsafe.Pointer(&buf[0])), C.uint(size))
-	}
+	b.in = buf[:size]
 }
 
 func (b *bzip) availOut() int {
-	return int(C.stream_avail_out(&b[0]))
+	return len(b.out)
 }
 
 func (b *bzip) setOutBuf(buf []byte, size int) {
-	if buf == nil || len(buf) == 0 {
-		C.stream_set_out_buf(&b[0], nil, C.uint(size))
-	} else {
-		C.stream_set_out_buf(&b[0], (*C.char)(unsafe.Pointer(&buf[0])), C.uint(size))
+	b.out = buf[:size]
+}
+
+// totalIn is the number of bytes consumed since the stream was initialized.
+func (b *bzip) totalIn() int64 {
+	if b.strm == nil {
+		return b.doneIn
 	}
+	return int64(C.stream_total_in(b.strm))
+}
+
+// totalOut is the number of bytes produced since the stream was initialized.
+func (b *bzip) totalOut() int64 {
+	if b.strm == nil {
+		return b.doneOut
+	}
+	return int64(C.stream_total_out(b.strm))
+}
+
+// bufs returns the buffers to hand to libbzip2 for a call. Anything past
+// what avail_in and avail_out can describe is left for the next call.
+func (b *bzip) bufs() (in *C.char, inLen C.uint, out *C.char, outLen C.uint) {
+	if len(b.in) > 0 {
+		in, inLen = (*C.char)(unsafe.Pointer(&b.in[0])), C.uint(min(len(b.in), math.MaxUint32))
+	}
+	if len(b.out) > 0 {
+		out, outLen = (*C.char)(unsafe.Pointer(&b.out[0])), C.uint(min(len(b.out), math.MaxUint32))
+	}
+	return
+}
+
+// advance drops what a call consumed from the buffers, given the lengths
+// handed to it.
+func (b *bzip) advance(inLen, outLen C.uint) {
+	b.in = b.in[inLen-b.strm.avail_in:]
+	b.out = b.out[outLen-b.strm.avail_out:]
 }
 
 func (b *bzip) compress(flag int) (int, error) {
-	ret := C.stream_compress(&b[0], C.int(flag))
+	if b.strm == nil {
+		return 0, &Error{Op: opCompress, Code: BZ_SEQUENCE_ERROR, Err: ErrSequence}
+	}
+	var internal C.int
+	in, inLen, out, outLen := b.bufs()
+	ret := C.stream_compress(b.strm, in, inLen, out, outLen, C.int(flag), &internal)
+	b.advance(inLen, outLen)
 	if ret < 0 {
-		return 0, retCodeToErr(int(ret))
+		return 0, b.compressError(ret, internal)
 	}
 	return int(ret), nil
 }
 
-func (b *bzip) decompress() int {
-	ret := C.stream_decompress(&b[0])
-	return int(ret)
+func (b *bzip) decompress() (int, error) {
+	if b.strm == nil {
+		return BZ_SEQUENCE_ERROR, &Error{Op: opDecompress, Code: BZ_SEQUENCE_ERROR, Err: ErrSequence}
+	}
+	var internal C.int
+	in, inLen, out, outLen := b.bufs()
+	ret := C.stream_decompress(b.strm, in, inLen, out, outLen, &internal)
+	b.advance(inLen, outLen)
+	if ret < 0 {
+		return int(ret), b.decompressError(ret, internal)
+	}
+	return int(ret), nil
 }
 
+// endCompress releases the stream. Only the first call after the stream is
+// initialized reaches BZ2_bzCompressEnd, later ones do nothing.
 func (b *bzip) endCompress() int {
-	return int(C.stream_compress_end(&b[0]))
+	if b.strm == nil {
+		return BZ_PARAM_ERROR
+	}
+	b.releaseHooks()
+	ret := int(C.stream_compress_end(b.strm))
+	b.free()
+	return ret
 }
 
+// endDecompress releases the stream. Only the first call after the stream
+// is initialized reaches BZ2_bzDecompressEnd, later ones do nothing.
 func (b *bzip) endDecompress() int {
-	return int(C.stream_decompress_end(&b[0]))
+	if b.strm == nil {
+		return BZ_PARAM_ERROR
+	}
+	b.releaseHooks()
+	ret := int(C.stream_decompress_end(b.strm))
+	b.free()
+	return ret
+}
+
+// ratio returns uncompressed/compressed, or 0 if nothing has been
+// compressed yet.
+func ratio(uncompressed, compressed int64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(uncompressed) / float64(compressed)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
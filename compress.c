@@ -629,6 +629,7 @@ void BZ2_compressBlock ( EState* s, Bool is_last_block )
 
    if (s->nblock > 0) {
 
+      BZ2_bz__CompressEvent ( s, BZ_EVENT_BLOCK );
       bsPutUChar ( s, 0x31 ); bsPutUChar ( s, 0x41 );
       bsPutUChar ( s, 0x59 ); bsPutUChar ( s, 0x26 );
       bsPutUChar ( s, 0x53 ); bsPutUChar ( s, 0x59 );
@@ -656,6 +657,7 @@ void BZ2_compressBlock ( EState* s, Bool is_last_block )
    /*-- If this is the last block, add the stream trailer. --*/
    if (is_last_block) {
 
+      BZ2_bz__CompressEvent ( s, BZ_EVENT_STREAM_END );
       bsPutUChar ( s, 0x17 ); bsPutUChar ( s, 0x72 );
       bsPutUChar ( s, 0x45 ); bsPutUChar ( s, 0x38 );
       bsPutUChar ( s, 0x50 ); bsPutUChar ( s, 0x90 );
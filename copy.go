@@ -0,0 +1,98 @@
+package cbzip2
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// copyBuffer returns a buffer for Reader.WriteTo or Writer.ReadFrom to
+// copy to or from other, reusing buf if it is large enough.
+func copyBuffer(buf []byte, other any) []byte {
+	n := copyBufferLen
+	if _, ok := other.(*os.File); ok {
+		n = fileBufferLen
+	}
+	if len(buf) >= n {
+		return buf
+	}
+	return alignedBuffer(n)
+}
+
+// alignedBuffer returns a buffer of n bytes starting on a page boundary,
+// which lets the kernel copy whole pages to and from files.
+func alignedBuffer(n int) []byte {
+	page := os.Getpagesize()
+	buf := make([]byte, n+page)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(page))
+	if off > 0 {
+		off = page - off
+	}
+	return buf[off : off+n : off+n]
+}
+
+// WriteTo implements io.WriterTo, so that io.Copy decompresses straight
+// into a buffer of the reader's own, larger than its default, and writes
+// it to w. It returns once the input has been read, with a nil error at the
+// end of the data. Data that could not be written to w is lost, so a write
+// error also stops the reader.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if err := r.guard.enter("Reader", r.opts.PanicOnConcurrentUse); err != nil {
+		return 0, err
+	}
+	defer r.guard.exit()
+	r.copyBuf = copyBuffer(r.copyBuf, w)
+	var total int64
+	for {
+		n, err := r.read(r.copyBuf)
+		if n > 0 {
+			m, werr := w.Write(r.copyBuf[:n])
+			total += int64(m)
+			if werr == nil && m < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return total, r.end(werr)
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy reads src into a
+// buffer of the writer's own, larger than its default, and compresses it
+// from there. It returns once src returns io.EOF, with the amount of input
+// compressed. As with Write, the data is not necessarily flushed, and an
+// error reading src leaves the writer usable.
+func (b *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if err := b.guard.enter("Writer", b.opts.PanicOnConcurrentUse); err != nil {
+		return 0, err
+	}
+	defer b.guard.exit()
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.copyBuf = copyBuffer(b.copyBuf, src)
+	var total int64
+	for {
+		n, rerr := src.Read(b.copyBuf)
+		if n > 0 {
+			m, err := b.write(b.copyBuf[:n])
+			total += int64(m)
+			if err != nil {
+				return total, err
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
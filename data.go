@@ -5,15 +5,37 @@ const (
 	// It should be a value between 1 and 9 inclusive, and the actual block size
 	// used is 100000 x this figure. 9 gives the best compression but takes most memory.
 	blockSize = 9 // default
-	// verbosity should be set to a number between 0 and 4 inclusive.
-	// 0 is silent, and greater numbers give increasingly verbose monitoring/debugging output.
-	verbosity = 0
 	// workFactor is the amount of effort the standard algorithm will expend before
 	// resorting to the fallback.
 	workFactor = 30 // default
+	// maxVerbosity is the most verbose libbzip2 trace level, 0 is silent.
+	maxVerbosity = 4
+	// maxWorkFactor is the largest work factor accepted by BZ2_bzCompressInit.
+	maxWorkFactor = 250
+
+	// bzInternalError is returned by the C wrappers in hooks.c when an
+	// internal assertion failed, it mirrors BZ_INTERNAL_ERROR in hooks.h.
+	bzInternalError = -100
+
+	// the operations reported in Error.Op
+	opInit       = "init"
+	opCompress   = "compress"
+	opDecompress = "decompress"
 
 	// bufferLen is our default buffer size, set to 32KB which is common for other io functions
 	bufferLen = 32 * 1024
+	// copyBufferLen is the buffer of Reader.WriteTo and Writer.ReadFrom,
+	// larger than io.Copy's to make fewer calls into libbzip2, and
+	// fileBufferLen replaces it when the other side is an *os.File
+	copyBufferLen = 256 * 1024
+	fileBufferLen = 1024 * 1024
+)
+
+// compression levels, mapped directly onto the bzip2 block size.
+const (
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
 )
 
 // copied from bzlib.h
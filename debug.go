@@ -0,0 +1,25 @@
+//go:build cbzip2debug
+
+package cbzip2
+
+/*
+#cgo CFLAGS: -DCBZIP2_DEBUG
+
+#include "hooks.h"
+*/
+import "C"
+
+import "log"
+
+// logLeak reports a Reader or Writer that was garbage collected without
+// being closed. It is only built with the cbzip2debug tag.
+func logLeak(what string) {
+	log.Printf("cbzip2: %s was not closed, freeing its stream", what)
+}
+
+// failAt makes the stream fail internal assertion code when it next
+// starts or ends a block, for testing. It is only built with the
+// cbzip2debug tag.
+func (b *bzip) failAt(code int) {
+	C.bz_ctx_set_fail(b.strm, C.int(code))
+}
@@ -0,0 +1,48 @@
+//go:build cbzip2debug
+
+package cbzip2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestInternalError(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	const code = 1007
+
+	check := func(err error) {
+		var ie *InternalError
+		if !errors.As(err, &ie) || ie.Code != code {
+			t.Fatalf("wanted err: %v, got: %v", &InternalError{Code: code}, err)
+		}
+	}
+
+	t.Logf("test: %s", "write")
+	wrtr, err := NewWriterOptions(io.Discard, &WriterOptions{BlockSize: 1})
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	wrtr.bz.failAt(code)
+	_, err = wrtr.Write(raw)
+	check(err)
+	if _, again := wrtr.Write(raw); again != err {
+		t.Fatalf("wanted err: %v, got: %v", err, again)
+	}
+	wrtr.Close()
+
+	t.Logf("test: %s", "read")
+	rdr, err := NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	rdr.bz.failAt(code)
+	_, err = rdr.Read(make([]byte, 1024))
+	check(err)
+	if _, again := rdr.Read(make([]byte, 1024)); again != err {
+		t.Fatalf("wanted err: %v, got: %v", err, again)
+	}
+	rdr.Close()
+}
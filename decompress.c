@@ -235,6 +235,7 @@ Int32 BZ2_decompress ( DState* s )
       if (uc != 0x59) RETURN(BZ_DATA_ERROR);
 
       s->currBlockNo++;
+      BZ2_bz__DecodeEvent ( s, BZ_EVENT_BLOCK );
       if (s->verbosity >= 2)
          VPrintf1 ( "\n    [%d: huff+mtf ", s->currBlockNo );
  
@@ -591,6 +592,7 @@ Int32 BZ2_decompress ( DState* s )
       if (uc != 0x50) RETURN(BZ_DATA_ERROR);
       GET_UCHAR(BZ_X_ENDHDR_6, uc);
       if (uc != 0x90) RETURN(BZ_DATA_ERROR);
+      BZ2_bz__DecodeEvent ( s, BZ_EVENT_STREAM_END );
 
       s->storedCombinedCRC = 0;
       GET_UCHAR(BZ_X_CCRC_1, uc);
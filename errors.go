@@ -1,6 +1,9 @@
 package cbzip2
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrBadParam = errors.New("bad parameters given to bzip")
@@ -13,8 +16,101 @@ var (
 	ErrOutFull  = errors.New("output buffer full")
 	ErrConfig   = errors.New("config error")
 	ErrUnknown  = errors.New("unknown error")
+
+	// ErrBlockSize and ErrWorkFactor say which parameter was bad, and
+	// wrap ErrBadParam
+	ErrBlockSize  = fmt.Errorf("%w: invalid block size, must be between 1 and 9", ErrBadParam)
+	ErrWorkFactor = fmt.Errorf("%w: invalid work factor, must be between 0 and 250", ErrBadParam)
+
+	ErrNegativeOffset = errors.New("negative offset")
+	ErrBadIndex       = errors.New("invalid block index")
+	ErrIndexVersion   = errors.New("unsupported block index version")
+	ErrLimitExceeded  = errors.New("decompression limit exceeded")
+	ErrClosed         = errors.New("use of closed bzip2 reader or writer")
+	ErrConcurrentUse  = errors.New("concurrent use of bzip2 reader or writer")
 )
 
+// InternalError is returned when libbzip2 detects an inconsistency in its
+// own state. Code is the assertion number bzip2 would have reported; 1007
+// is commonly caused by unreliable memory. The stream that returned it can
+// no longer be used, but the rest of the process is unaffected.
+type InternalError struct {
+	Code int
+}
+
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("bzip2 internal error number %d", e.Code)
+}
+
+// Error is returned when libbzip2 fails, with what is known about where in
+// the stream it happened. It wraps one of the errors above, or an
+// *InternalError, so errors.Is and errors.As can be used to check why.
+type Error struct {
+	// Op is the operation that failed: "init", "compress" or
+	// "decompress".
+	Op string
+	// Code is the BZ_* value returned by libbzip2.
+	Code int
+	// Block is the number of the block being processed, counting from 1
+	// across all the streams read, or 0 if the error is not about a
+	// block.
+	Block int
+	// CompressedOffset and UncompressedOffset are the start of the block
+	// in the compressed and uncompressed data, or if Block is 0, the
+	// number of bytes consumed and produced when the error was detected.
+	CompressedOffset   int64
+	UncompressedOffset int64
+	// StoredCRC and ComputedCRC are the checksums that did not match
+	// when a CRC check failed, for the block or, if Block is 0, for the
+	// whole stream. Both are 0 for other errors.
+	StoredCRC   uint32
+	ComputedCRC uint32
+	Err         error
+}
+
+func (e *Error) Error() string {
+	msg := e.Err.Error()
+	if e.StoredCRC != e.ComputedCRC {
+		msg = "CRC mismatch"
+		if e.Block == 0 {
+			msg = "combined CRC mismatch"
+		}
+	}
+	s := "bzip2 " + e.Op + ": " + msg
+	if e.Block > 0 {
+		s += fmt.Sprintf(" in block %d", e.Block)
+	}
+	if e.Op != opInit {
+		s += fmt.Sprintf(" at compressed offset %d, uncompressed offset %d", e.CompressedOffset, e.UncompressedOffset)
+	}
+	if e.StoredCRC != e.ComputedCRC {
+		s += fmt.Sprintf(" (stored 0x%08x, computed 0x%08x)", e.StoredCRC, e.ComputedCRC)
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// SkipError is returned at the end of the input by a Reader with
+// SkipCorrupt set that dropped blocks. It wraps ErrBadData.
+type SkipError struct {
+	Skipped []SkippedBlock
+}
+
+func (e *SkipError) Error() string {
+	var lost int64
+	for _, b := range e.Skipped {
+		lost += b.EstimatedSize
+	}
+	return fmt.Sprintf("bzip2: skipped %d corrupt blocks, about %d bytes lost", len(e.Skipped), lost)
+}
+
+func (e *SkipError) Unwrap() error {
+	return ErrBadData
+}
+
 func retCodeToErr(ret int) error {
 	switch ret {
 	case BZ_SEQUENCE_ERROR:
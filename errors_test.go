@@ -0,0 +1,83 @@
+package cbzip2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestErrorContext(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	// flip a bit of the CRC stored after the magic of the third block
+	blk := idx.Blocks[2]
+	bit := blk.CompressedOffset + 48 + 5
+	badCRC := append([]byte{}, compressed...)
+	badCRC[bit/8] ^= 0x80 >> (bit % 8)
+
+	stream := len(compressed) - 10
+	badCombined := append([]byte{}, compressed...)
+	badCombined[stream+6] ^= 1
+
+	second := append(append([]byte{}, compressed...), badCRC...)
+
+	tt := []struct {
+		msg      string
+		data     []byte
+		block    int
+		in, out  int64
+		combined bool
+	}{
+		{msg: "block crc", data: badCRC, block: 3, in: blk.CompressedOffset / 8, out: blk.UncompressedOffset},
+		{msg: "block crc in second stream", data: second, block: 3 + len(idx.Blocks), in: int64(len(compressed)) + blk.CompressedOffset/8, out: int64(len(raw)) + blk.UncompressedOffset},
+		{msg: "combined crc", data: badCombined, combined: true},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		rdr, err := NewReader(bytes.NewReader(v.data))
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		_, err = io.Copy(io.Discard, rdr)
+		if !errors.Is(err, ErrBadData) {
+			t.Fatalf("wanted err: %v, got: %v", ErrBadData, err)
+		}
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("wanted *Error, got: %T", err)
+		}
+		if e.Op != opDecompress || e.Code != BZ_DATA_ERROR || e.StoredCRC == e.ComputedCRC {
+			t.Fatalf("unexpected error: %+v", e)
+		}
+		if v.combined {
+			if e.Block != 0 || !strings.Contains(e.Error(), "combined CRC mismatch") {
+				t.Fatalf("wanted a combined CRC mismatch, got: %v", e)
+			}
+			continue
+		}
+		if e.Block != v.block || e.CompressedOffset != v.in || e.UncompressedOffset != v.out {
+			t.Fatalf("wanted block %d at %d/%d, got: %v", v.block, v.in, v.out, e)
+		}
+
+		// the parallel reader places the error the same way
+		pr, err := NewParallelReader(bytes.NewReader(v.data), nil)
+		if err != nil {
+			t.Fatalf("error creating parallel reader: %s", err)
+		}
+		_, err = io.Copy(io.Discard, pr)
+		pr.Close()
+		var pe *Error
+		if !errors.As(err, &pe) || *pe != *e {
+			t.Fatalf("wanted err: %v, got: %v", e, err)
+		}
+	}
+
+	if _, err := NewReaderOptions(bytes.NewReader(nil), &ReaderOptions{Verbosity: 5}); !errors.Is(err, ErrBadParam) {
+		t.Fatalf("wanted err: %v, got: %v", ErrBadParam, err)
+	}
+}
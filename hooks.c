@@ -0,0 +1,254 @@
+#include <setjmp.h>
+#include <stdarg.h>
+#include <stddef.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "bzlib_private.h"
+#include "hooks.h"
+#include "_cgo_export.h"
+
+/* the stream currently being driven on this thread, if any. A cgo call
+   never migrates between threads, so this is stable for the duration of
+   a single BZ2_bzCompress / BZ2_bzDecompress call. */
+static __thread bz_stream* bz_current = NULL;
+
+/* where to unwind to when an internal assertion fails, and why */
+static __thread jmp_buf*   bz_guard = NULL;
+static __thread int        bz_guard_code = 0;
+
+void BZ2_bz__AssertH__recover ( int errcode )
+{
+   if (bz_guard == NULL) return;
+   bz_guard_code = errcode;
+   longjmp ( *bz_guard, 1 );
+}
+
+void BZ2_bz__VPrintf ( const char* fmt, ... )
+{
+   char    buf[1024];
+   int     n;
+   va_list ap;
+
+   va_start ( ap, fmt );
+   if (bz_current == NULL || bz_current->opaque == NULL
+       || ((bz_stream_ctx*)bz_current->opaque)->handle == 0
+       || !((bz_stream_ctx*)bz_current->opaque)->log) {
+      vfprintf ( stderr, fmt, ap );
+      va_end ( ap );
+      return;
+   }
+   n = vsnprintf ( buf, sizeof(buf), fmt, ap );
+   va_end ( ap );
+   if (n < 0) return;
+   if (n >= (int)sizeof(buf)) n = sizeof(buf) - 1;
+   goBzipLog ( ((bz_stream_ctx*)bz_current->opaque)->handle, buf, n );
+}
+
+int bz_hooked_compress ( bz_stream* strm, int action, int* internal )
+{
+   jmp_buf      guard;
+   volatile int ret;
+
+   bz_current = strm;
+   if (setjmp ( guard ) == 0) {
+      bz_guard = &guard;
+      ret = BZ2_bzCompress ( strm, action );
+   } else {
+      *internal = bz_guard_code;
+      ret = BZ_INTERNAL_ERROR;
+   }
+   bz_guard = NULL;
+   bz_current = NULL;
+   return ret;
+}
+
+int bz_hooked_decompress ( bz_stream* strm, int* internal )
+{
+   jmp_buf      guard;
+   volatile int ret;
+
+   bz_current = strm;
+   if (setjmp ( guard ) == 0) {
+      bz_guard = &guard;
+      ret = BZ2_bzDecompress ( strm );
+   } else {
+      *internal = bz_guard_code;
+      ret = BZ_INTERNAL_ERROR;
+   }
+   bz_guard = NULL;
+   bz_current = NULL;
+   return ret;
+}
+
+void BZ2_bz__DecodeEvent ( DState* s, Int32 event )
+{
+   bz_stream*         strm = s->strm;
+   bz_stream_ctx*     ctx = strm->opaque;
+   unsigned long long pos;
+
+#ifdef CBZIP2_DEBUG
+   if (ctx != NULL && ctx->fail != 0) BZ2_bz__AssertH__fail ( ctx->fail );
+#endif
+   if (event == BZ_EVENT_BLOCK) {
+      /* the previous block has all been handed out by now */
+      s->blockStartIn = (((unsigned long long)strm->total_in_hi32 << 32)
+                         | strm->total_in_lo32) * 8 - s->bsLive - 48;
+      s->blockStartOut = ((unsigned long long)strm->total_out_hi32 << 32)
+                         | strm->total_out_lo32;
+   }
+   if (ctx == NULL || ctx->handle == 0) return;
+   if (event == BZ_EVENT_BLOCK_DONE) {
+      /* the block's output has all been handed out */
+      pos = ((unsigned long long)strm->total_out_hi32 << 32)
+            | strm->total_out_lo32;
+   } else {
+      /* the bit offset of the magic that has just been read */
+      pos = ((unsigned long long)strm->total_in_hi32 << 32)
+            | strm->total_in_lo32;
+      pos = pos * 8 - s->bsLive - 48;
+   }
+   goBzipDecodeEvent ( ctx->handle, event, pos,
+                       s->storedBlockCRC, BZ_HDR_0 + s->blockSize100k );
+}
+
+void BZ2_bz__CompressEvent ( EState* s, Int32 event )
+{
+   bz_stream*         strm = s->strm;
+   bz_stream_ctx*     ctx = strm->opaque;
+   unsigned long long pos, in;
+
+#ifdef CBZIP2_DEBUG
+   if (ctx != NULL && ctx->fail != 0) BZ2_bz__AssertH__fail ( ctx->fail );
+#endif
+   if (ctx == NULL || ctx->handle == 0) return;
+   /* everything before this block has already been handed out, so the
+      magic about to be written starts after that, the bytes of this
+      block written so far and the bits waiting in bsBuff. */
+   pos = ((unsigned long long)strm->total_out_hi32 << 32)
+         | strm->total_out_lo32;
+   pos = (pos + s->numZ) * 8 + s->bsLive;
+   /* the input consumed, less a run still waiting to be added to the
+      next block */
+   in = ((unsigned long long)strm->total_in_hi32 << 32)
+        | strm->total_in_lo32;
+   if (s->state_in_ch < 256) in -= s->state_in_len;
+   goBzipCompressEvent ( ctx->handle, event, pos, in,
+                         s->blockCRC, BZ_HDR_0 + s->blockSize100k );
+}
+
+void bz_compress_info ( bz_stream* strm, bz_stream_info* info )
+{
+   EState* s = strm->state;
+
+   memset ( info, 0, sizeof(*info) );
+   if (s == NULL) return;
+   info->block = s->blockNo;
+}
+
+void bz_decompress_info ( bz_stream* strm, bz_stream_info* info )
+{
+   DState* s = strm->state;
+
+   memset ( info, 0, sizeof(*info) );
+   if (s == NULL) return;
+   info->block           = s->currBlockNo;
+   info->block_start_in  = s->blockStartIn;
+   info->block_start_out = s->blockStartOut;
+   if (s->state == BZ_X_OUTPUT
+       && s->nblock_used == s->save_nblock+1 && s->state_out_len == 0
+       && s->calculatedBlockCRC != s->storedBlockCRC) {
+      /* the check at the end of a block in BZ2_bzDecompress failed */
+      info->crc          = BZ_CRC_BLOCK;
+      info->stored_crc   = s->storedBlockCRC;
+      info->computed_crc = s->calculatedBlockCRC;
+   } else if (s->state == BZ_X_IDLE
+              && s->calculatedCombinedCRC != s->storedCombinedCRC) {
+      /* the check at the end of the stream failed */
+      info->crc          = BZ_CRC_COMBINED;
+      info->stored_crc   = s->storedCombinedCRC;
+      info->computed_crc = s->calculatedCombinedCRC;
+   }
+}
+
+/* the memory allocated by all streams, and the most there may be */
+static long long bz_heap_used = 0;
+static long long bz_heap_limit = 0;
+
+/* every allocation starts with its size, keeping malloc's alignment */
+typedef union {
+   long long   size;
+   max_align_t align;
+} bz_alloc_header;
+
+bz_stream_ctx* bz_ctx_new ( uintptr_t handle, int log, long long budget )
+{
+   bz_stream_ctx* ctx = malloc ( sizeof(*ctx) );
+
+   if (ctx == NULL) return NULL;
+   ctx->handle = handle;
+   ctx->log    = log;
+   ctx->used   = 0;
+   ctx->budget = budget;
+#ifdef CBZIP2_DEBUG
+   ctx->fail   = 0;
+#endif
+   return ctx;
+}
+
+#ifdef CBZIP2_DEBUG
+void bz_ctx_set_fail ( bz_stream* strm, int code )
+{
+   bz_stream_ctx* ctx = strm->opaque;
+
+   if (ctx != NULL) ctx->fail = code;
+}
+#endif
+
+void* bz_ctx_alloc ( void* opaque, int items, int size )
+{
+   bz_stream_ctx*   ctx = opaque;
+   long long        n = (long long)items * size;
+   long long        limit = __atomic_load_n ( &bz_heap_limit, __ATOMIC_RELAXED );
+   bz_alloc_header* h;
+
+   if (ctx->budget > 0 && ctx->used + n > ctx->budget) return NULL;
+   /* claim the memory first, so that concurrent streams can't all slip
+      under the limit together */
+   if (__atomic_add_fetch ( &bz_heap_used, n, __ATOMIC_RELAXED ) > limit
+       && limit > 0) {
+      __atomic_sub_fetch ( &bz_heap_used, n, __ATOMIC_RELAXED );
+      return NULL;
+   }
+   h = malloc ( sizeof(*h) + n );
+   if (h == NULL) {
+      __atomic_sub_fetch ( &bz_heap_used, n, __ATOMIC_RELAXED );
+      return NULL;
+   }
+   h->size = n;
+   ctx->used += n;
+   return h + 1;
+}
+
+void bz_ctx_free ( void* opaque, void* p )
+{
+   bz_stream_ctx*   ctx = opaque;
+   bz_alloc_header* h;
+
+   if (p == NULL) return;
+   h = (bz_alloc_header*)p - 1;
+   ctx->used -= h->size;
+   __atomic_sub_fetch ( &bz_heap_used, h->size, __ATOMIC_RELAXED );
+   free ( h );
+}
+
+long long bz_heap_in_use ( void )
+{
+   return __atomic_load_n ( &bz_heap_used, __ATOMIC_RELAXED );
+}
+
+long long bz_set_heap_limit ( long long limit )
+{
+   return __atomic_exchange_n ( &bz_heap_limit, limit, __ATOMIC_RELAXED );
+}
@@ -0,0 +1,61 @@
+package cbzip2
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// streamHooks receives the callbacks libbzip2 makes on behalf of a single
+// stream. A handle to it is stored in the opaque field of the bz_stream.
+type streamHooks struct {
+	log   io.Writer
+	index *indexRecorder
+}
+
+// newStreamHooks returns the hooks for a stream, or nil if there is
+// nothing to hook and the library defaults should be kept.
+func newStreamHooks(log io.Writer, index *indexRecorder) *streamHooks {
+	if log == nil && index == nil {
+		return nil
+	}
+	return &streamHooks{log: log, index: index}
+}
+
+// logs reports whether the trace output of the stream goes to h, rather
+// than to stderr.
+func (h *streamHooks) logs() bool {
+	return h != nil && h.log != nil
+}
+
+//export goBzipLog
+func goBzipLog(handle C.uintptr_t, msg *C.char, n C.int) {
+	h := cgo.Handle(handle).Value().(*streamHooks)
+	if h.log == nil {
+		return
+	}
+	// there is nowhere to report a failure to, and the C side would
+	// have ignored one from stderr too
+	_, _ = h.log.Write(C.GoBytes(unsafe.Pointer(msg), n))
+}
+
+//export goBzipDecodeEvent
+func goBzipDecodeEvent(handle C.uintptr_t, event C.int, pos C.ulonglong, crc C.uint, level C.int) {
+	h := cgo.Handle(handle).Value().(*streamHooks)
+	if h.index != nil {
+		h.index.decodeEvent(int(event), int64(pos), uint32(crc), byte(level))
+	}
+}
+
+//export goBzipCompressEvent
+func goBzipCompressEvent(handle C.uintptr_t, event C.int, pos, in C.ulonglong, crc C.uint, level C.int) {
+	h := cgo.Handle(handle).Value().(*streamHooks)
+	if h.index != nil {
+		h.index.compressEvent(int(event), int64(pos), int64(in), uint32(crc), byte(level))
+	}
+}
@@ -0,0 +1,79 @@
+#ifndef _CBZIP2_HOOKS_H
+#define _CBZIP2_HOOKS_H
+
+#include <stdint.h>
+
+#include "bzlib.h"
+
+/* returned when an internal assertion failed during the call */
+#define BZ_INTERNAL_ERROR (-100)
+
+/* bz_hooked_compress and bz_hooked_decompress run a single
+   BZ2_bzCompress / BZ2_bzDecompress call with strm registered as the
+   current stream of the calling thread, so that diagnostics raised
+   deep inside the library can be attributed to it.
+   If an internal assertion fails, the call is abandoned, the assertion
+   number is stored in *internal and BZ_INTERNAL_ERROR is returned. */
+int bz_hooked_compress ( bz_stream* strm, int action, int* internal );
+int bz_hooked_decompress ( bz_stream* strm, int* internal );
+
+/* the opaque field of every bz_stream set up by the package points at its
+   bz_stream_ctx, which holds the Go side of the stream and accounts for
+   the memory libbzip2 allocates for it through bz_ctx_alloc and
+   bz_ctx_free. */
+typedef struct {
+   /* the cgo.Handle of the Go hooks, 0 if there are none */
+   uintptr_t handle;
+   /* whether the Go hooks take the trace output, which otherwise goes
+      to stderr */
+   int       log;
+   /* bytes allocated for the stream, and the most it may have, 0 for no
+      limit */
+   long long used;
+   long long budget;
+#ifdef CBZIP2_DEBUG
+   /* if not 0, the assertion number to fail with at the next block, so
+      that tests can see how internal errors are reported */
+   int       fail;
+#endif
+} bz_stream_ctx;
+
+bz_stream_ctx* bz_ctx_new ( uintptr_t handle, int log, long long budget );
+void*          bz_ctx_alloc ( void* opaque, int items, int size );
+void           bz_ctx_free ( void* opaque, void* p );
+
+#ifdef CBZIP2_DEBUG
+/* makes strm fail assertion code at its next block, for testing */
+void           bz_ctx_set_fail ( bz_stream* strm, int code );
+#endif
+
+/* the memory allocated through bz_ctx_alloc across all streams, and the
+   most there may be at once, 0 for no limit. bz_set_heap_limit returns
+   the previous limit. */
+long long bz_heap_in_use ( void );
+long long bz_set_heap_limit ( long long limit );
+
+/* what is known about the position of a stream, for error reports */
+typedef struct {
+   /* the number of the current block, counting from 1, 0 before the
+      first one */
+   int                block;
+   /* where the current block started, as a bit offset in the compressed
+      data and a byte offset in the uncompressed data. Decompression
+      only. */
+   unsigned long long block_start_in;
+   unsigned long long block_start_out;
+   /* BZ_CRC_BLOCK or BZ_CRC_COMBINED if a CRC check failed, and the
+      values that were compared. Decompression only. */
+   int                crc;
+   unsigned int       stored_crc;
+   unsigned int       computed_crc;
+} bz_stream_info;
+
+#define BZ_CRC_BLOCK    1
+#define BZ_CRC_COMBINED 2
+
+void bz_compress_info ( bz_stream* strm, bz_stream_info* info );
+void bz_decompress_info ( bz_stream* strm, bz_stream_info* info );
+
+#endif
@@ -0,0 +1,297 @@
+package cbzip2
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// the events reported by the compressor and decompressor, mirroring
+// BZ_EVENT_* in bzlib_private.h
+const (
+	decodeEventBlock = iota
+	decodeEventBlockDone
+	decodeEventStreamEnd
+)
+
+// the .bz2idx sidecar format: indexMagic, a version byte, the number of
+// blocks and each block, all as uvarints except the level byte and the
+// CRC, followed by the IEEE CRC-32 of everything before it.
+const (
+	indexMagic   = "BZIX"
+	indexVersion = 1
+)
+
+// Index records where each block of a bzip2 file starts, both in the
+// compressed input and in the decompressed output, so that decoding can
+// start at any block.
+type Index struct {
+	Blocks []IndexBlock
+}
+
+// IndexBlock describes a single block.
+type IndexBlock struct {
+	// CompressedOffset is the bit offset of the block magic in the
+	// compressed input, and CompressedBits the length of the block.
+	CompressedOffset int64
+	CompressedBits   int64
+	// UncompressedOffset is the offset of the block's data in the
+	// decompressed output, and UncompressedSize its length.
+	UncompressedOffset int64
+	UncompressedSize   int64
+	// Level is the block size digit of the block's stream.
+	Level byte
+	// CRC is the block CRC.
+	CRC uint32
+}
+
+// Size returns the length of the decompressed output.
+func (idx *Index) Size() int64 {
+	if len(idx.Blocks) == 0 {
+		return 0
+	}
+	last := idx.Blocks[len(idx.Blocks)-1]
+	return last.UncompressedOffset + last.UncompressedSize
+}
+
+// find returns the index of the block containing uncompressed offset off.
+func (idx *Index) find(off int64) int {
+	return sort.Search(len(idx.Blocks), func(i int) bool {
+		b := idx.Blocks[i]
+		return b.UncompressedOffset+b.UncompressedSize > off
+	})
+}
+
+// add records a block decoded from segs into out.
+func (idx *Index) add(segs []*blockSegment, out []byte) {
+	b := IndexBlock{
+		CompressedOffset:   segs[0].offset,
+		UncompressedOffset: idx.Size(),
+		UncompressedSize:   int64(len(out)),
+		Level:              segs[0].level,
+		CRC:                segs[0].crc,
+	}
+	for _, seg := range segs {
+		b.CompressedBits += seg.nbits
+	}
+	idx.Blocks = append(idx.Blocks, b)
+}
+
+// BuildIndex decodes all of r, which may hold several concatenated
+// streams, and returns the index of its blocks. The blocks are decoded
+// concurrently, as by ParallelReader.
+func BuildIndex(r io.Reader) (*Index, error) {
+	idx := &Index{}
+	pr, err := NewParallelReader(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.Close()
+	pr.onBlock = idx.add
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// segment reads the compressed block b from src.
+func (b *IndexBlock) segment(src io.ReaderAt) (*blockSegment, error) {
+	start := b.CompressedOffset / 8
+	end := (b.CompressedOffset + b.CompressedBits + 7) / 8
+	data := make([]byte, end-start)
+	if n, err := src.ReadAt(data, start); n < len(data) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &blockSegment{
+		data:     data,
+		startBit: uint(b.CompressedOffset % 8),
+		nbits:    b.CompressedBits,
+		offset:   b.CompressedOffset,
+		level:    b.Level,
+		crc:      b.CRC,
+	}, nil
+}
+
+// MarshalBinary encodes the index in the versioned .bz2idx format.
+func (idx *Index) MarshalBinary() ([]byte, error) {
+	b := append([]byte(indexMagic), indexVersion)
+	b = binary.AppendUvarint(b, uint64(len(idx.Blocks)))
+	for _, blk := range idx.Blocks {
+		b = binary.AppendUvarint(b, uint64(blk.CompressedOffset))
+		b = binary.AppendUvarint(b, uint64(blk.CompressedBits))
+		b = binary.AppendUvarint(b, uint64(blk.UncompressedOffset))
+		b = binary.AppendUvarint(b, uint64(blk.UncompressedSize))
+		b = append(b, blk.Level)
+		b = binary.BigEndian.AppendUint32(b, blk.CRC)
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// UnmarshalBinary decodes an index encoded by MarshalBinary. It returns
+// ErrIndexVersion for an index written by a newer version of the package,
+// and ErrBadIndex if the data is not a valid index.
+func (idx *Index) UnmarshalBinary(data []byte) error {
+	if len(data) < len(indexMagic)+1+4 || string(data[:len(indexMagic)]) != indexMagic {
+		return ErrBadIndex
+	}
+	if data[len(indexMagic)] != indexVersion {
+		return ErrIndexVersion
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return ErrBadIndex
+	}
+	d := indexDecoder{b: body[len(indexMagic)+1:]}
+	n := d.uvarint()
+	// each block takes at least 9 bytes, don't trust n any further
+	if n > uint64(len(d.b))/9 {
+		return ErrBadIndex
+	}
+	blocks := make([]IndexBlock, n)
+	for i := range blocks {
+		blocks[i].CompressedOffset = int64(d.uvarint())
+		blocks[i].CompressedBits = int64(d.uvarint())
+		blocks[i].UncompressedOffset = int64(d.uvarint())
+		blocks[i].UncompressedSize = int64(d.uvarint())
+		blocks[i].Level = d.byte()
+		blocks[i].CRC = d.uint32()
+	}
+	if d.bad || len(d.b) != 0 {
+		return ErrBadIndex
+	}
+	loaded := Index{Blocks: blocks}
+	if err := loaded.validate(); err != nil {
+		return err
+	}
+	*idx = loaded
+	return nil
+}
+
+// validate checks that the blocks of idx could describe a bzip2 file: they
+// follow each other in both the input and the output, and none is larger
+// than its level allows. It returns ErrBadIndex if not.
+func (idx *Index) validate() error {
+	var nextIn, nextOut int64
+	for _, b := range idx.Blocks {
+		if b.Level < '1' || b.Level > '9' {
+			return ErrBadIndex
+		}
+		maxBits, maxSize := blockLimits(b.Level)
+		if b.CompressedOffset < nextIn || b.CompressedBits <= 0 || b.CompressedBits > maxBits {
+			return ErrBadIndex
+		}
+		if b.UncompressedOffset != nextOut || b.UncompressedSize < 0 || b.UncompressedSize > maxSize {
+			return ErrBadIndex
+		}
+		nextIn = b.CompressedOffset + b.CompressedBits
+		nextOut = b.UncompressedOffset + b.UncompressedSize
+	}
+	return nil
+}
+
+// blockLimits returns the most compressed bits and decompressed bytes a
+// block of the given level can have. A block holds up to level x 100000
+// bytes of run-length encoded data, in which 5 bytes expand to at most 259,
+// and even incompressible data grows by far less than a quarter.
+func blockLimits(level byte) (bits, size int64) {
+	n := int64(level-'0') * 100000
+	return 8 * (n + n/4 + 1024), (n/5 + 1) * 259
+}
+
+// indexDecoder reads the fields of an encoded index, remembering whether
+// it ran out of data.
+type indexDecoder struct {
+	b   []byte
+	bad bool
+}
+
+func (d *indexDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > 1<<62 {
+		d.bad, d.b = true, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *indexDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.bad = true
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *indexDecoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.bad, d.b = true, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+// indexRecorder builds an Index from the events reported by a
+// decompressor as it decodes.
+type indexRecorder struct {
+	idx Index
+	// inBase and outBase locate the current stream in the input, in
+	// bits, and in the output, in bytes
+	inBase  int64
+	outBase int64
+	// cur is the block being decoded, done once its output has been
+	// checked; its compressed length is only known at the next magic
+	cur  IndexBlock
+	done bool
+}
+
+func (ir *indexRecorder) decodeEvent(event int, pos int64, crc uint32, level byte) {
+	switch event {
+	case decodeEventBlock:
+		ir.finish(ir.inBase + pos)
+		ir.cur = IndexBlock{CompressedOffset: ir.inBase + pos, Level: level}
+	case decodeEventBlockDone:
+		ir.cur.UncompressedOffset = ir.idx.Size()
+		ir.cur.UncompressedSize = ir.outBase + pos - ir.cur.UncompressedOffset
+		ir.cur.CRC = crc
+		ir.done = true
+	case decodeEventStreamEnd:
+		ir.finish(ir.inBase + pos)
+	}
+}
+
+// compressEvent records a block as it is written by a compressor. in is
+// the amount of input that went into the blocks so far, including this
+// one.
+func (ir *indexRecorder) compressEvent(event int, pos, in int64, crc uint32, level byte) {
+	ir.finish(pos)
+	if event == decodeEventBlock {
+		ir.cur = IndexBlock{
+			CompressedOffset:   pos,
+			UncompressedOffset: ir.idx.Size(),
+			UncompressedSize:   in - ir.idx.Size(),
+			Level:              level,
+			CRC:                crc,
+		}
+		ir.done = true
+	}
+}
+
+// finish adds the current block to the index, if it is complete, now that
+// the magic following it has been found at bit offset next.
+func (ir *indexRecorder) finish(next int64) {
+	if !ir.done {
+		return
+	}
+	ir.cur.CompressedBits = next - ir.cur.CompressedOffset
+	ir.idx.Blocks = append(ir.idx.Blocks, ir.cur)
+	ir.done = false
+}
@@ -0,0 +1,231 @@
+package cbzip2
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestBuildIndex(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	second, err := Compress(nil, raw[:1000], nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	compressed = append(compressed, second...)
+	raw = append(raw, raw[:1000]...)
+
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	if idx.Size() != int64(len(raw)) {
+		t.Fatalf("wanted index size %d, got %d", len(raw), idx.Size())
+	}
+
+	// the same index is built while decoding normally
+	rdr, err := NewReaderOptions(bytes.NewReader(compressed), &ReaderOptions{BuildIndex: true})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if _, err := io.Copy(io.Discard, rdr); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if !reflect.DeepEqual(idx, rdr.Index()) {
+		t.Logf("scanned: %+v", idx)
+		t.Logf("decoded: %+v", rdr.Index())
+		t.Fatal("index built by Reader does not match BuildIndex")
+	}
+
+	b, err := idx.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshaling index: %s", err)
+	}
+	var loaded Index
+	if err := loaded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("error unmarshaling index: %s", err)
+	}
+	if !reflect.DeepEqual(idx, &loaded) {
+		t.Fatal("unmarshaled index does not match")
+	}
+	ir, err := NewIndexedReader(bytes.NewReader(compressed), int64(len(compressed)), &loaded)
+	if err != nil {
+		t.Fatalf("error creating indexed reader: %s", err)
+	}
+	p := make([]byte, 5000)
+	off := loaded.Blocks[len(loaded.Blocks)-2].UncompressedOffset - 2500
+	if _, err := ir.ReadAt(p, off); err != nil {
+		t.Fatalf("error reading at %d: %s", off, err)
+	}
+	if !bytes.Equal(raw[off:off+5000], p) {
+		t.Fatal("data read with the loaded index did not match")
+	}
+
+	corrupt := append([]byte{}, b...)
+	corrupt[len(corrupt)/2] ^= 1
+	if err := loaded.UnmarshalBinary(corrupt); err != ErrBadIndex {
+		t.Fatalf("wanted err: %v, got: %v", ErrBadIndex, err)
+	}
+	newer := append([]byte{}, b...)
+	newer[len(indexMagic)]++
+	if err := loaded.UnmarshalBinary(newer); err != ErrIndexVersion {
+		t.Fatalf("wanted err: %v, got: %v", ErrIndexVersion, err)
+	}
+	if err := loaded.UnmarshalBinary(b[:10]); err != ErrBadIndex {
+		t.Fatalf("wanted err: %v, got: %v", ErrBadIndex, err)
+	}
+}
+
+func TestWriterIndex(t *testing.T) {
+	raw, _ := multiBlock(t)
+	// long runs are held back by the run-length encoder, so they straddle
+	// block boundaries
+	raw = append(raw, bytes.Repeat([]byte{'a'}, 250*1024)...)
+
+	var compressed, sidecar bytes.Buffer
+	wrtr, err := NewWriterOptions(&compressed, &WriterOptions{BlockSize: 1, IndexWriter: &sidecar})
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	half := len(raw) / 2
+	for _, chunk := range [][]byte{raw[:half], raw[half:]} {
+		if _, err := wrtr.Write(chunk); err != nil {
+			t.Fatalf("error compressing data: %s", err)
+		}
+		// a flush ends the current block early
+		if err := wrtr.Flush(); err != nil {
+			t.Fatalf("error flushing data: %s", err)
+		}
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("error closing writer: %s", err)
+	}
+
+	idx, err := BuildIndex(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	if !reflect.DeepEqual(idx, wrtr.Index()) {
+		t.Logf("scanned: %+v", idx)
+		t.Logf("written: %+v", wrtr.Index())
+		t.Fatal("index built by Writer does not match BuildIndex")
+	}
+	var loaded Index
+	if err := loaded.UnmarshalBinary(sidecar.Bytes()); err != nil {
+		t.Fatalf("error unmarshaling index: %s", err)
+	}
+	if !reflect.DeepEqual(idx, &loaded) {
+		t.Fatal("index written at Close does not match")
+	}
+
+	// without BuildIndex or IndexWriter, nothing is recorded
+	wrtr, err = NewWriter(io.Discard)
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	defer wrtr.Close()
+	if wrtr.Index() != nil {
+		t.Fatal("wanted no index without BuildIndex")
+	}
+}
+
+func TestIndexValidation(t *testing.T) {
+	_, compressed := multiBlock(t)
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	if len(idx.Blocks) < 2 {
+		t.Fatalf("wanted several blocks, got %d", len(idx.Blocks))
+	}
+	tt := []struct {
+		msg    string
+		modify func(b []IndexBlock)
+	}{
+		{msg: "gap in the output", modify: func(b []IndexBlock) {
+			b[1].UncompressedOffset += 1000
+		}},
+		{msg: "overlap in the output", modify: func(b []IndexBlock) {
+			b[0].UncompressedSize++
+		}},
+		{msg: "first block not at 0", modify: func(b []IndexBlock) {
+			b[0].UncompressedOffset = 10
+		}},
+		{msg: "blocks out of order in the input", modify: func(b []IndexBlock) {
+			b[1].CompressedOffset = b[0].CompressedOffset
+		}},
+		{msg: "huge compressed block", modify: func(b []IndexBlock) {
+			b[0].CompressedBits = 1 << 62
+		}},
+		{msg: "empty compressed block", modify: func(b []IndexBlock) {
+			b[0].CompressedBits = 0
+		}},
+		{msg: "huge uncompressed block", modify: func(b []IndexBlock) {
+			b[len(b)-1].UncompressedSize = 1 << 40
+		}},
+		{msg: "bad level", modify: func(b []IndexBlock) {
+			b[0].Level = '0'
+		}},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		bad := &Index{Blocks: append([]IndexBlock{}, idx.Blocks...)}
+		v.modify(bad.Blocks)
+		// the encoding is fine, only the contents are wrong
+		b, err := bad.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshaling index: %s", err)
+		}
+		loaded := Index{Blocks: idx.Blocks}
+		if err := loaded.UnmarshalBinary(b); err != ErrBadIndex {
+			t.Fatalf("wanted err: %v, got: %v", ErrBadIndex, err)
+		}
+		if !reflect.DeepEqual(loaded.Blocks, idx.Blocks) {
+			t.Fatal("a rejected index replaced the previous one")
+		}
+		if _, err := NewIndexedReader(bytes.NewReader(compressed), int64(len(compressed)), bad); err != ErrBadIndex {
+			t.Fatalf("wanted err: %v, got: %v", ErrBadIndex, err)
+		}
+	}
+
+	// ReadAt doesn't trust the index either
+	gap := &Index{Blocks: append([]IndexBlock{}, idx.Blocks...)}
+	gap.Blocks[1].UncompressedOffset += 1000
+	ir := &IndexedReader{src: bytes.NewReader(compressed), idx: gap, cacheBlock: -1}
+	off := gap.Blocks[1].UncompressedOffset - 500
+	if _, err := ir.ReadAt(make([]byte, 100), off); err != ErrBadIndex {
+		t.Fatalf("wanted err: %v, got: %v", ErrBadIndex, err)
+	}
+}
+
+func TestIndexVerbosity(t *testing.T) {
+	// the trace output of an indexed stream without a Log goes to stderr
+	raw := bytes.Repeat([]byte("hello, world "), 1024)
+	var compressed bytes.Buffer
+	wrtr, err := NewWriterOptions(&compressed, &WriterOptions{BuildIndex: true, Verbosity: 2})
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	if _, err := wrtr.Write(raw); err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("error closing writer: %s", err)
+	}
+
+	rdr, err := NewReaderOptions(bytes.NewReader(compressed.Bytes()), &ReaderOptions{BuildIndex: true, Verbosity: 2})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	out, err := io.ReadAll(rdr)
+	if err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if !bytes.Equal(out, raw) {
+		t.Fatal("decompressed data does not match")
+	}
+	if !reflect.DeepEqual(rdr.Index(), wrtr.Index()) {
+		t.Fatal("index built by Reader does not match the Writer's")
+	}
+}
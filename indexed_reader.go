@@ -0,0 +1,128 @@
+package cbzip2
+
+import (
+	"io"
+	"sync"
+)
+
+// IndexedReader gives random access to the decompressed contents of a
+// bzip2 file. Using an Index of the file's blocks, it decodes only the
+// blocks that overlap the requested range. The most recently decoded block
+// is cached, so small sequential reads do not decode a block repeatedly.
+//
+// ReadAt may be called concurrently; Read and Seek share a single offset
+// and may not.
+type IndexedReader struct {
+	src io.ReaderAt
+	idx *Index
+	pos int64
+
+	mu         sync.Mutex
+	cacheBlock int
+	cache      []byte
+}
+
+// NewIndexedReader returns an IndexedReader over the bzip2 file held in
+// the first size bytes of src. If idx is nil, the index is built by
+// decoding the whole file first. An idx that could not describe a bzip2
+// file gives ErrBadIndex.
+func NewIndexedReader(src io.ReaderAt, size int64, idx *Index) (*IndexedReader, error) {
+	if idx == nil {
+		var err error
+		if idx, err = BuildIndex(io.NewSectionReader(src, 0, size)); err != nil {
+			return nil, err
+		}
+	} else if err := idx.validate(); err != nil {
+		return nil, err
+	}
+	return &IndexedReader{src: src, idx: idx, cacheBlock: -1}, nil
+}
+
+// Size returns the length of the decompressed contents.
+func (ir *IndexedReader) Size() int64 {
+	return ir.idx.Size()
+}
+
+// ReadAt implements io.ReaderAt over the decompressed contents.
+func (ir *IndexedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	n := 0
+	for i := ir.idx.find(off); n < len(p) && i < len(ir.idx.Blocks); i++ {
+		data, err := ir.block(i)
+		if err != nil {
+			return n, err
+		}
+		start := off + int64(n) - ir.idx.Blocks[i].UncompressedOffset
+		if start < 0 || start > int64(len(data)) {
+			// the blocks of the index don't follow each other
+			return n, ErrBadIndex
+		}
+		n += copy(p[n:], data[start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the decompressed data of block i.
+func (ir *IndexedReader) block(i int) ([]byte, error) {
+	ir.mu.Lock()
+	if ir.cacheBlock == i {
+		defer ir.mu.Unlock()
+		return ir.cache, nil
+	}
+	ir.mu.Unlock()
+
+	b := &ir.idx.Blocks[i]
+	seg, err := b.segment(ir.src)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeBlock(nil, seg)
+	if err != nil {
+		return nil, placeError(err, i+1, b.CompressedOffset, b.UncompressedOffset)
+	}
+	if int64(len(data)) != b.UncompressedSize {
+		// the index doesn't describe this file
+		return nil, ErrBadData
+	}
+
+	ir.mu.Lock()
+	ir.cacheBlock, ir.cache = i, data
+	ir.mu.Unlock()
+	return data, nil
+}
+
+// Read implements io.Reader, reading from the current offset.
+func (ir *IndexedReader) Read(p []byte) (int, error) {
+	if ir.pos >= ir.Size() {
+		return 0, io.EOF
+	}
+	n, err := ir.ReadAt(p, ir.pos)
+	ir.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker over the decompressed contents.
+func (ir *IndexedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ir.pos
+	case io.SeekEnd:
+		offset += ir.Size()
+	default:
+		return 0, ErrBadParam
+	}
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	ir.pos = offset
+	return offset, nil
+}
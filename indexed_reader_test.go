@@ -0,0 +1,67 @@
+package cbzip2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestIndexedReader(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	second, err := Compress(nil, []byte("second stream"), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	raw = append(raw, "second stream"...)
+	compressed = append(compressed, second...)
+
+	ir, err := NewIndexedReader(bytes.NewReader(compressed), int64(len(compressed)), nil)
+	if err != nil {
+		t.Fatalf("error creating indexed reader: %s", err)
+	}
+	if len(ir.idx.Blocks) < 3 {
+		t.Fatalf("expected several blocks in the index, got %d", len(ir.idx.Blocks))
+	}
+	if ir.Size() != int64(len(raw)) {
+		t.Fatalf("wanted size %d, got %d", len(raw), ir.Size())
+	}
+	tt := []struct {
+		msg       string
+		off, size int64
+	}{
+		{msg: "start", off: 0, size: 100},
+		{msg: "across a block boundary", off: ir.idx.Blocks[1].UncompressedOffset - 50, size: 100},
+		{msg: "several blocks", off: 1000, size: ir.idx.Blocks[2].UncompressedOffset},
+		{msg: "last stream", off: int64(len(raw)) - 13, size: 13},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		p := make([]byte, v.size)
+		if _, err := ir.ReadAt(p, v.off); err != nil {
+			t.Fatalf("error reading at %d: %s", v.off, err)
+		}
+		if !bytes.Equal(raw[v.off:v.off+v.size], p) {
+			t.Fatalf("data read at %d did not match", v.off)
+		}
+	}
+
+	// reading past the end is short
+	n, err := ir.ReadAt(make([]byte, 10), int64(len(raw))-5)
+	if n != 5 || err != io.EOF {
+		t.Fatalf("wanted 5 bytes and EOF, got %d bytes and %v", n, err)
+	}
+
+	if _, err := ir.Seek(-13, io.SeekEnd); err != nil {
+		t.Fatalf("error seeking: %s", err)
+	}
+	rest, err := io.ReadAll(ir)
+	if err != nil {
+		t.Fatalf("error reading after seek: %s", err)
+	}
+	if string(rest) != "second stream" {
+		t.Fatalf("read %q after seeking", rest)
+	}
+	if _, err := ir.Seek(-1, io.SeekStart); err != ErrNegativeOffset {
+		t.Fatalf("wanted err: %v, got: %v", ErrNegativeOffset, err)
+	}
+}
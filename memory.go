@@ -0,0 +1,24 @@
+package cbzip2
+
+/*
+#include "hooks.h"
+*/
+import "C"
+
+// MemoryInUse returns the number of bytes libbzip2 currently has allocated,
+// across all the streams of the package. This memory is allocated with
+// malloc, outside of the Go heap and its limits.
+func MemoryInUse() int64 {
+	return int64(C.bz_heap_in_use())
+}
+
+// SetMemoryLimit sets the most memory libbzip2 may have allocated at once,
+// across all the streams of the package, and returns the previous limit.
+// A stream that would go over it fails with ErrMem. A limit of 0, the
+// default, means no limit.
+func SetMemoryLimit(limit int64) int64 {
+	if limit < 0 {
+		limit = 0
+	}
+	return int64(C.bz_set_heap_limit(C.longlong(limit)))
+}
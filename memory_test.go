@@ -0,0 +1,70 @@
+package cbzip2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	// blocks still being decoded for the parallel reader tests may be
+	// freed at any time, so only the streams of this test are compared
+	// exactly
+	base := MemoryInUse()
+	var compressed bytes.Buffer
+	wrtr, err := NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	// 400k + 8 x the block size
+	if used := wrtr.MemoryInUse(); used < 8*900000 || MemoryInUse() < used {
+		t.Fatalf("unexpected memory use: %d for the writer, %d in all", used, MemoryInUse()-base)
+	}
+	if _, err := wrtr.Write(bytes.Repeat([]byte("hello, world "), 1000)); err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("error closing writer: %s", err)
+	}
+	if wrtr.MemoryInUse() != 0 {
+		t.Fatalf("memory still in use after Close: %d", wrtr.MemoryInUse())
+	}
+
+	tt := []struct {
+		msg     string
+		opts    ReaderOptions
+		wantErr error
+	}{
+		{msg: "within budget", opts: ReaderOptions{MemoryBudget: 8 << 20}},
+		{msg: "over budget", opts: ReaderOptions{MemoryBudget: 1 << 20}, wantErr: ErrMem},
+		{msg: "small within budget", opts: ReaderOptions{MemoryBudget: 3 << 20, Small: true}},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		rdr, err := NewReaderOptions(bytes.NewReader(compressed.Bytes()), &v.opts)
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		_, err = io.Copy(io.Discard, rdr)
+		if !errors.Is(err, v.wantErr) {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, err)
+		}
+		rdr.Close()
+		if rdr.MemoryInUse() != 0 {
+			t.Fatalf("memory still in use after Close: %d", rdr.MemoryInUse())
+		}
+	}
+
+	if _, err := NewWriterOptions(io.Discard, &WriterOptions{MemoryBudget: 1 << 20}); !errors.Is(err, ErrMem) {
+		t.Fatalf("wanted err: %v, got: %v", ErrMem, err)
+	}
+	prev := SetMemoryLimit(base + 2<<20)
+	defer SetMemoryLimit(prev)
+	if _, err := NewWriter(io.Discard); !errors.Is(err, ErrMem) {
+		t.Fatalf("wanted err: %v, got: %v", ErrMem, err)
+	}
+	if _, err := Compress(nil, []byte("hello"), &WriterOptions{BlockSize: 1}); err != nil {
+		t.Fatalf("error compressing under the limit: %s", err)
+	}
+}
@@ -0,0 +1,294 @@
+package cbzip2
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// maxSplitSegments bounds how many segments the reader will join while
+// looking for a block that was split by a magic number in its data. Such
+// a split is already astronomically unlikely.
+const maxSplitSegments = 4
+
+// ParallelReaderOptions controls a ParallelReader.
+type ParallelReaderOptions struct {
+	// Workers is the number of blocks decoded concurrently.
+	// 0 selects runtime.GOMAXPROCS(0).
+	Workers int
+}
+
+// ParallelReader decompresses like a Reader, but decodes the blocks of a
+// stream concurrently, in the style of lbzip2. The input is split into
+// blocks by searching for the block magic number, each block is decoded
+// and checked against its CRC on its own, and the output is produced in
+// order after checking each stream's combined CRC. Concatenated streams
+// are supported. At most Workers blocks are decoded, and Workers results
+// buffered, at any one time.
+type ParallelReader struct {
+	queue chan *parallelBlock
+	quit  chan struct{}
+	once  sync.Once
+	// done is closed once the scanner has stopped reading the input
+	done chan struct{}
+
+	// pending are blocks taken from the queue but not yet used
+	pending []*parallelBlock
+	// onBlock, if set, is called with each block as it is returned
+	onBlock func(segs []*blockSegment, out []byte)
+	// onSkip, if set, is called with each block that fails to decode,
+	// which is then dropped rather than failing the read and added to
+	// dropped
+	onSkip  func(SkippedBlock)
+	dropped []SkippedBlock
+	// decode, if set, are the options the blocks are decoded with
+	decode *ReaderOptions
+	// single stops the read at the end of the first stream
+	single   bool
+	combined uint32
+	// skipped is set if a block of the current stream was dropped, so its
+	// combined CRC can't be checked
+	skipped bool
+	// streams and blocks count the streams and blocks found so far, total
+	// and totalBits the output and input of the blocks returned, and in
+	// the input consumed
+	streams   int
+	blocks    int
+	total     int64
+	totalBits int64
+	in        int64
+	// next is the bit offset at which the next block or stream starts
+	next int64
+	out  []byte
+	err  error
+}
+
+// parallelBlock is a block, end of stream or error on its way through the
+// decoders.
+type parallelBlock struct {
+	ev    *scanEvent
+	out   []byte
+	err   error
+	ready chan struct{}
+}
+
+// NewParallelReader returns a ParallelReader decompressing r. A nil opts is
+// equivalent to the zero ParallelReaderOptions.
+func NewParallelReader(r io.Reader, opts *ParallelReaderOptions) (*ParallelReader, error) {
+	return newParallelReader(r, opts, nil)
+}
+
+// newParallelReader is NewParallelReader, decoding the blocks with decode
+// if it isn't nil.
+func newParallelReader(r io.Reader, opts *ParallelReaderOptions, decode *ReaderOptions) (*ParallelReader, error) {
+	if opts == nil {
+		opts = &ParallelReaderOptions{}
+	}
+	if opts.Workers < 0 {
+		return nil, ErrBadParam
+	}
+	workers := opts.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	pr := &ParallelReader{
+		queue:  make(chan *parallelBlock, workers),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+		decode: decode,
+	}
+	go pr.scanLoop(newBlockScanner(r), make(chan struct{}, workers))
+	return pr, nil
+}
+
+// scanLoop splits the input into blocks and starts decoding them, queuing
+// them in input order.
+func (pr *ParallelReader) scanLoop(s *blockScanner, sem chan struct{}) {
+	defer close(pr.done)
+	defer close(pr.queue)
+	for {
+		ev, err := s.next()
+		if err == io.EOF {
+			return
+		}
+		b := &parallelBlock{ev: ev, err: err, ready: make(chan struct{})}
+		select {
+		case pr.queue <- b:
+		case <-pr.quit:
+			return
+		}
+		if err != nil || ev.block == nil {
+			close(b.ready)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-pr.quit:
+			return
+		}
+		go func() {
+			defer func() { <-sem }()
+			b.out, b.err = decodeBlock(pr.decode, b.ev.block)
+			close(b.ready)
+		}()
+	}
+}
+
+// Read reads decompressed data.
+func (pr *ParallelReader) Read(p []byte) (int, error) {
+	for len(pr.out) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		pr.err = pr.advance()
+	}
+	n := copy(p, pr.out)
+	pr.out = pr.out[n:]
+	return n, nil
+}
+
+// advance moves on to the next block in the input, leaving its data in
+// pr.out.
+func (pr *ParallelReader) advance() error {
+	b := pr.nextBlock()
+	if b == nil {
+		return io.EOF
+	}
+	<-b.ready
+	if b.ev == nil {
+		if b.err == io.ErrUnexpectedEOF {
+			// the input ends inside the block or stream after those
+			// returned so far
+			return &Error{
+				Op:                 opDecompress,
+				Code:               BZ_UNEXPECTED_EOF,
+				Block:              pr.blocks + 1,
+				CompressedOffset:   pr.next / 8,
+				UncompressedOffset: pr.total,
+				Err:                io.ErrUnexpectedEOF,
+			}
+		}
+		if b.err == ErrBadMagic {
+			// what follows the streams returned so far isn't another
+			return &Error{
+				Op:                 opDecompress,
+				Code:               BZ_DATA_ERROR_MAGIC,
+				CompressedOffset:   pr.next / 8,
+				UncompressedOffset: pr.total,
+				Err:                ErrBadMagic,
+			}
+		}
+		return b.err
+	}
+	if b.ev.block == nil {
+		// end of stream
+		pr.in = (b.ev.offset + magicBits + crcBits + 7) / 8
+		pr.next = 8 * pr.in
+		if pr.combined != b.ev.streamCRC && !pr.skipped {
+			return &Error{
+				Op:                 opDecompress,
+				Code:               BZ_DATA_ERROR,
+				CompressedOffset:   b.ev.offset / 8,
+				UncompressedOffset: pr.total,
+				StoredCRC:          b.ev.streamCRC,
+				ComputedCRC:        pr.combined,
+				Err:                ErrBadData,
+			}
+		}
+		pr.combined = 0
+		pr.skipped = false
+		pr.streams++
+		if pr.single {
+			return io.EOF
+		}
+		return nil
+	}
+	out, err := b.out, b.err
+	segs := []*blockSegment{b.ev.block}
+	taken := []*parallelBlock{b}
+	// a failure could be a magic number in the block data splitting it
+	// in two, try again joined to the segment that follows. Running out of
+	// memory says nothing about the data.
+	corrupt := func() bool { return err != nil && !errors.Is(err, ErrMem) }
+	for corrupt() && len(segs) < maxSplitSegments {
+		next := pr.nextBlock()
+		if next == nil {
+			break
+		}
+		if next.ev == nil || next.ev.block == nil {
+			pr.pending = append(pr.pending, next)
+			break
+		}
+		segs = append(segs, next.ev.block)
+		taken = append(taken, next)
+		out, err = decodeBlock(pr.decode, segs...)
+	}
+	if corrupt() && pr.onSkip != nil {
+		pr.skip(segs[0])
+		// the segments that followed may be blocks of their own
+		pr.pending = append(taken[1:], pr.pending...)
+		return nil
+	}
+	if err != nil {
+		return placeError(err, pr.blocks+1, segs[0].offset, pr.total)
+	}
+	pr.combined = combineCRC(pr.combined, segs[0].crc)
+	pr.blocks++
+	pr.total += int64(len(out))
+	for _, seg := range segs {
+		pr.totalBits += seg.nbits
+	}
+	last := segs[len(segs)-1]
+	pr.next = last.offset + last.nbits
+	pr.in = (pr.next + 7) / 8
+	pr.out = out
+	if pr.onBlock != nil {
+		pr.onBlock(segs, out)
+	}
+	return nil
+}
+
+// skip drops the block starting with seg, which failed to decode.
+func (pr *ParallelReader) skip(seg *blockSegment) {
+	pr.blocks++
+	pr.skipped = true
+	pr.next = seg.offset + seg.nbits
+	pr.in = (pr.next + 7) / 8
+	lost := estimateLost(seg, pr.total, pr.totalBits)
+	b := SkippedBlock{Block: pr.blocks, CompressedOffset: seg.offset / 8, EstimatedSize: lost}
+	pr.dropped = append(pr.dropped, b)
+	pr.onSkip(b)
+}
+
+// nextBlock returns the next block in input order, or nil at the end.
+func (pr *ParallelReader) nextBlock() *parallelBlock {
+	if len(pr.pending) > 0 {
+		b := pr.pending[0]
+		pr.pending = pr.pending[1:]
+		return b
+	}
+	b, ok := <-pr.queue
+	if !ok {
+		return nil
+	}
+	return b
+}
+
+// Close stops decoding. The input is read ahead in the background, so
+// Close waits for a Read of the underlying io.Reader that is under way to
+// return; after that it is no longer used. It is not closed.
+func (pr *ParallelReader) Close() error {
+	pr.stop()
+	<-pr.done
+	pr.err = io.EOF
+	return nil
+}
+
+// stop tells the scanner to stop, without waiting for it.
+func (pr *ParallelReader) stop() {
+	pr.once.Do(func() { close(pr.quit) })
+}
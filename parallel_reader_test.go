@@ -0,0 +1,233 @@
+package cbzip2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// multiBlock returns data that compresses to several level 1 blocks, and
+// its compressed form.
+func multiBlock(t testing.TB) ([]byte, []byte) {
+	var raw bytes.Buffer
+	for i := 0; i < 4; i++ {
+		if _, err := io.CopyN(&raw, rand.Reader, 120*1024); err != nil {
+			t.Fatalf("error generating random data: %s", err)
+		}
+		raw.Write(bytes.Repeat([]byte("hello, world "), 8*1024))
+	}
+	compressed, err := Compress(nil, raw.Bytes(), &WriterOptions{BlockSize: 1})
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	return raw.Bytes(), compressed
+}
+
+func TestParallelReader(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	// a second stream, to check stream boundaries are handled
+	second, err := Compress(nil, []byte("second stream"), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	raw = append(raw, "second stream"...)
+	compressed = append(compressed, second...)
+	for _, workers := range []int{1, 4} {
+		t.Logf("decompressing with %d workers", workers)
+		pr, err := NewParallelReader(bytes.NewReader(compressed), &ParallelReaderOptions{Workers: workers})
+		if err != nil {
+			t.Fatalf("error creating parallel reader: %s", err)
+		}
+		out, err := io.ReadAll(pr)
+		if err != nil {
+			t.Fatalf("error decompressing data: %s", err)
+		}
+		if !reflect.DeepEqual(raw, out) {
+			t.Fatal("parallel decompressed data does not match")
+		}
+		if err := pr.Close(); err != nil {
+			t.Fatalf("error closing parallel reader: %s", err)
+		}
+	}
+}
+
+func TestParallelReaderErrors(t *testing.T) {
+	_, compressed := multiBlock(t)
+	corrupt := append([]byte{}, compressed...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	tt := []struct {
+		msg     string
+		data    []byte
+		wantErr error
+	}{
+		{msg: "corrupt block", data: corrupt, wantErr: ErrBadData},
+		{msg: "truncated", data: compressed[:len(compressed)-20], wantErr: io.ErrUnexpectedEOF},
+		{msg: "bad header", data: []byte("BZx9"), wantErr: ErrBadMagic},
+		{msg: "trailing garbage", data: append(append([]byte{}, compressed...), make([]byte, 100)...), wantErr: ErrBadMagic},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		pr, err := NewParallelReader(bytes.NewReader(v.data), nil)
+		if err != nil {
+			t.Fatalf("error creating parallel reader: %s", err)
+		}
+		_, err = io.Copy(io.Discard, pr)
+		if !errors.Is(err, v.wantErr) {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, err)
+		}
+		pr.Close()
+	}
+}
+
+func TestSplitBlock(t *testing.T) {
+	raw := bytes.Repeat([]byte("split me "), 1000)
+	compressed, err := Compress(nil, raw, nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	ev, err := newBlockScanner(bytes.NewReader(compressed)).next()
+	if err != nil {
+		t.Fatalf("error scanning data: %s", err)
+	}
+	seg := ev.block
+	// split the block at an odd bit, as a magic number in its data would
+	for _, at := range []int64{100, 101, 107, seg.nbits - 3} {
+		first := &blockSegment{data: seg.data, startBit: seg.startBit, nbits: at, level: seg.level, crc: seg.crc}
+		pos := int64(seg.startBit) + at
+		second := &blockSegment{data: seg.data[pos/8:], startBit: uint(pos % 8), nbits: seg.nbits - at}
+		out, err := decodeBlock(nil, first, second)
+		if err != nil {
+			t.Fatalf("error decoding block split at bit %d: %s", at, err)
+		}
+		if !bytes.Equal(raw, out) {
+			t.Fatalf("block split at bit %d did not decode to the input", at)
+		}
+	}
+}
+
+func TestNextMagic(t *testing.T) {
+	// magic numbers at every bit alignment, among random data
+	noise := make([]byte, 4096)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatalf("error generating random data: %s", err)
+	}
+	w := &bitWriter{}
+	w.buf = append(w.buf, "BZh1"...)
+	for i := 0; i < 64; i++ {
+		for _, b := range noise[:i*37%97] {
+			w.writeBits(uint64(b), 8)
+		}
+		w.writeBits(uint64(i%8), uint(i%8))
+		magic := uint64(blockMagic)
+		if i%2 == 1 {
+			magic = eosMagic
+		}
+		w.writeBits(magic>>24, 24)
+		w.writeBits(magic&(1<<24-1), 24)
+	}
+	data := w.bytes()
+
+	// the magic numbers found checking every bit
+	var want []int64
+	var reg uint64
+	for pos := int64(0); pos < 8*int64(len(data)); pos++ {
+		reg = reg<<1 | uint64(data[pos/8]>>(7-uint(pos%8))&1)
+		if m := reg & magicMask; (m == blockMagic || m == eosMagic) && pos+1-magicBits >= 8*headerLen {
+			want = append(want, pos+1-magicBits)
+		}
+	}
+	if len(want) < 64 {
+		t.Fatalf("wanted at least 64 magic numbers, found %d", len(want))
+	}
+
+	// read a few bytes at a time, so the search stops part way through
+	s := newBlockScanner(iotest.HalfReader(bytes.NewReader(data)))
+	s.start, s.cand = -1, -1
+	var got []int64
+	for {
+		_, at, err := s.nextMagic()
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error searching data: %s", err)
+		}
+		got = append(got, at)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wanted magic numbers at %v, got %v", want, got)
+	}
+}
+
+func TestParallelReaderClose(t *testing.T) {
+	_, compressed := multiBlock(t)
+	tt := []struct {
+		msg  string
+		open func(r io.Reader) (io.Closer, error)
+	}{
+		{msg: "parallel reader", open: func(r io.Reader) (io.Closer, error) { return NewParallelReader(r, nil) }},
+		{msg: "skip corrupt", open: func(r io.Reader) (io.Closer, error) {
+			return NewReaderOptions(r, &ReaderOptions{SkipCorrupt: true})
+		}},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		br := newBlockingReader(compressed)
+		c, err := v.open(br)
+		if err != nil {
+			t.Fatalf("error creating reader: %s", err)
+		}
+		// the input is read in the background without a call to Read
+		<-br.entered
+		done := make(chan error)
+		go func() { done <- c.Close() }()
+		select {
+		case <-done:
+			t.Fatal("Close returned while the input was being read")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(br.release)
+		if err := <-done; err != nil {
+			t.Fatalf("error closing reader: %s", err)
+		}
+	}
+}
+
+func BenchmarkBlockScanner(b *testing.B) {
+	_, compressed := multiBlock(b)
+	b.SetBytes(int64(len(compressed)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newBlockScanner(bytes.NewReader(compressed))
+		for {
+			_, err := s.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("error scanning blocks: %s", err)
+			}
+		}
+	}
+}
+
+func BenchmarkParallelReader(b *testing.B) {
+	raw, compressed := multiBlock(b)
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pr, err := NewParallelReader(bytes.NewReader(compressed), nil)
+		if err != nil {
+			b.Fatalf("error creating parallel reader: %s", err)
+		}
+		if _, err := io.Copy(io.Discard, pr); err != nil {
+			b.Fatalf("error decompressing data: %s", err)
+		}
+		pr.Close()
+	}
+}
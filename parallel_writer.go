@@ -0,0 +1,213 @@
+package cbzip2
+
+import (
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ParallelWriterOptions controls a ParallelWriter. The WriterOptions apply
+// to each chunk, with MemoryBudget limiting each compressor on its own.
+// The chunks share Log, whose writes are serialized but may interleave
+// between chunks. BuildIndex and IndexWriter are not supported, and make
+// NewParallelWriter fail with ErrBadParam.
+type ParallelWriterOptions struct {
+	WriterOptions
+	// Workers is the number of chunks compressed concurrently.
+	// 0 selects runtime.GOMAXPROCS(0).
+	Workers int
+}
+
+// ParallelWriter compresses like a Writer, but cuts its input into
+// block-sized chunks that are compressed concurrently, in the style of
+// pbzip2. Each chunk becomes its own bzip2 stream and the streams are
+// written to the underlying writer in order, so the output is a
+// concatenated bzip2 file readable by Reader, compress/bzip2 and the bzip2
+// command. At most Workers chunks are compressed, and Workers results
+// buffered, at any one time; Write blocks until there is room.
+type ParallelWriter struct {
+	opts  ParallelWriterOptions
+	buf   []byte
+	sem   chan struct{}
+	queue chan *parallelChunk
+	done  chan struct{}
+	// wrote is set once the first chunk is dispatched
+	wrote  bool
+	closed bool
+
+	mu  sync.Mutex
+	err error
+}
+
+// parallelChunk is a chunk of input on its way through the compressors.
+type parallelChunk struct {
+	out   []byte
+	err   error
+	ready chan struct{}
+	// flushed, if set, is closed once the chunk has been written
+	flushed chan struct{}
+}
+
+// NewParallelWriter returns a ParallelWriter writing to w. A nil opts is
+// equivalent to the zero ParallelWriterOptions.
+// It is the caller's responsibility to call Close on the ParallelWriter.
+func NewParallelWriter(w io.Writer, opts *ParallelWriterOptions) (*ParallelWriter, error) {
+	if opts == nil {
+		opts = &ParallelWriterOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Workers < 0 || opts.BuildIndex || opts.IndexWriter != nil {
+		return nil, ErrBadParam
+	}
+	pw := &ParallelWriter{opts: *opts}
+	if pw.opts.Workers == 0 {
+		pw.opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if pw.opts.Log != nil {
+		pw.opts.Log = &lockedWriter{w: pw.opts.Log}
+	}
+	pw.buf = make([]byte, 0, pw.chunkSize())
+	pw.sem = make(chan struct{}, pw.opts.Workers)
+	pw.queue = make(chan *parallelChunk, pw.opts.Workers)
+	pw.done = make(chan struct{})
+	go pw.writeLoop(w)
+	return pw, nil
+}
+
+// chunkSize is the amount of input compressed as a single stream, the
+// size of one bzip2 block.
+func (pw *ParallelWriter) chunkSize() int {
+	return pw.opts.blockSize() * 100000
+}
+
+// Write buffers d, handing each full chunk to a compressor. It returns
+// ErrClosed after Close.
+func (pw *ParallelWriter) Write(d []byte) (int, error) {
+	if pw.closed {
+		return 0, ErrClosed
+	}
+	if err := pw.getErr(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(d) > 0 {
+		n := copy(pw.buf[len(pw.buf):cap(pw.buf)], d)
+		pw.buf = pw.buf[:len(pw.buf)+n]
+		d = d[n:]
+		written += n
+		if len(pw.buf) == cap(pw.buf) {
+			pw.dispatch()
+			if err := pw.getErr(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush compresses any buffered input and waits until everything written
+// so far has been passed to the underlying writer. It returns ErrClosed
+// after Close.
+func (pw *ParallelWriter) Flush() error {
+	if pw.closed {
+		return ErrClosed
+	}
+	if err := pw.getErr(); err != nil {
+		return err
+	}
+	if len(pw.buf) > 0 {
+		pw.dispatch()
+	}
+	// an empty chunk, once the write loop gets to it everything queued
+	// before it has been written
+	marker := &parallelChunk{ready: make(chan struct{}), flushed: make(chan struct{})}
+	close(marker.ready)
+	pw.queue <- marker
+	<-marker.flushed
+	return pw.getErr()
+}
+
+// Close compresses any buffered input, waits for all chunks to be written
+// and returns the first error encountered, or ErrClosed if it is already
+// closed. It does not close the underlying io.Writer.
+func (pw *ParallelWriter) Close() error {
+	if pw.closed {
+		return ErrClosed
+	}
+	pw.closed = true
+	// an empty input still needs to produce a valid (empty) bzip2 file
+	if len(pw.buf) > 0 || !pw.wrote {
+		pw.dispatch()
+	}
+	close(pw.queue)
+	<-pw.done
+	return pw.getErr()
+}
+
+// dispatch hands the current buffer to a compressor goroutine and queues
+// its result for writing. It blocks while Workers chunks are in flight.
+func (pw *ParallelWriter) dispatch() {
+	pw.wrote = true
+	c := &parallelChunk{ready: make(chan struct{})}
+	data := pw.buf
+	pw.buf = make([]byte, 0, pw.chunkSize())
+
+	pw.queue <- c
+	pw.sem <- struct{}{}
+	go func() {
+		defer func() { <-pw.sem }()
+		c.out, c.err = Compress(nil, data, &pw.opts.WriterOptions)
+		close(c.ready)
+	}()
+}
+
+// writeLoop writes compressed chunks to w in the order they were queued.
+func (pw *ParallelWriter) writeLoop(w io.Writer) {
+	defer close(pw.done)
+	for c := range pw.queue {
+		<-c.ready
+		if c.err != nil {
+			pw.setErr(c.err)
+		}
+		if len(c.out) > 0 && pw.getErr() == nil {
+			n, err := w.Write(c.out)
+			if err == nil && n < len(c.out) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				pw.setErr(err)
+			}
+		}
+		if c.flushed != nil {
+			close(c.flushed)
+		}
+	}
+}
+
+func (pw *ParallelWriter) getErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *ParallelWriter) setErr(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// lockedWriter serializes the writes of the compressors sharing a Log.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
@@ -0,0 +1,146 @@
+package cbzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"crypto/rand"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParallelWriter(t *testing.T) {
+	// mix incompressible and repetitive data so chunks compress unevenly
+	var raw bytes.Buffer
+	for i := 0; i < 5; i++ {
+		if _, err := io.CopyN(&raw, rand.Reader, 150*1024); err != nil {
+			t.Fatalf("error generating random data: %s", err)
+		}
+		raw.Write(bytes.Repeat([]byte("hello, world "), 10*1024))
+	}
+	for _, workers := range []int{1, 4} {
+		t.Logf("compressing with %d workers", workers)
+		var compressed bytes.Buffer
+		pw, err := NewParallelWriter(&compressed, &ParallelWriterOptions{
+			WriterOptions: WriterOptions{BlockSize: 1},
+			Workers:       workers,
+		})
+		if err != nil {
+			t.Fatalf("error creating parallel writer: %s", err)
+		}
+		// write in odd sized pieces to exercise chunk boundaries
+		src := raw.Bytes()
+		for len(src) > 0 {
+			n := 12345
+			if n > len(src) {
+				n = len(src)
+			}
+			if _, err := pw.Write(src[:n]); err != nil {
+				t.Fatalf("error writing data: %s", err)
+			}
+			src = src[n:]
+		}
+		if err := pw.Flush(); err != nil {
+			t.Fatalf("error flushing parallel writer: %s", err)
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatalf("failed to close parallel writer: %s", err)
+		}
+
+		var goDecomp bytes.Buffer
+		if _, err := io.Copy(&goDecomp, bzip2.NewReader(bytes.NewReader(compressed.Bytes()))); err != nil {
+			t.Fatalf("error decompressing with go: %s", err)
+		}
+		if !reflect.DeepEqual(raw.Bytes(), goDecomp.Bytes()) {
+			t.Fatal("go decompressed data does not match")
+		}
+		rdr, err := NewReader(&compressed)
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		var cDecomp bytes.Buffer
+		if _, err := io.Copy(&cDecomp, rdr); err != nil {
+			t.Fatalf("error decompressing with c: %s", err)
+		}
+		if !reflect.DeepEqual(raw.Bytes(), cDecomp.Bytes()) {
+			t.Fatal("c decompressed data does not match")
+		}
+	}
+}
+
+func TestParallelWriterEmpty(t *testing.T) {
+	var compressed bytes.Buffer
+	pw, err := NewParallelWriter(&compressed, nil)
+	if err != nil {
+		t.Fatalf("error creating parallel writer: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("failed to close parallel writer: %s", err)
+	}
+	out, err := Decompress(nil, compressed.Bytes())
+	if err != nil {
+		t.Fatalf("error decompressing empty output: %s", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected no output, got %d bytes", len(out))
+	}
+}
+
+func TestParallelWriterClosed(t *testing.T) {
+	pw, err := NewParallelWriter(io.Discard, nil)
+	if err != nil {
+		t.Fatalf("error creating parallel writer: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("failed to close parallel writer: %s", err)
+	}
+	if err := pw.Flush(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+	// enough to fill a chunk, which would otherwise be dispatched
+	if _, err := pw.Write(make([]byte, pw.chunkSize())); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+	if err := pw.Close(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+}
+
+func TestParallelWriterOptions(t *testing.T) {
+	for _, opts := range []WriterOptions{
+		{BuildIndex: true},
+		{IndexWriter: io.Discard},
+	} {
+		t.Logf("test: %+v", opts)
+		if _, err := NewParallelWriter(io.Discard, &ParallelWriterOptions{WriterOptions: opts}); err != ErrBadParam {
+			t.Fatalf("wanted err: %v, got: %v", ErrBadParam, err)
+		}
+	}
+
+	// the compressors share the log, run under -race to check it
+	raw, _ := multiBlock(t)
+	var log, compressed bytes.Buffer
+	pw, err := NewParallelWriter(&compressed, &ParallelWriterOptions{
+		WriterOptions: WriterOptions{BlockSize: 1, Verbosity: 4, Log: &log},
+		Workers:       4,
+	})
+	if err != nil {
+		t.Fatalf("error creating parallel writer: %s", err)
+	}
+	if _, err := pw.Write(raw); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatalf("failed to close parallel writer: %s", err)
+	}
+	if log.Len() == 0 {
+		t.Fatal("wanted trace output in the log")
+	}
+	rdr, err := NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if out, err := io.ReadAll(rdr); err != nil || !bytes.Equal(out, raw) {
+		t.Fatalf("round trip failed, err: %v", err)
+	}
+}
@@ -1,34 +1,308 @@
 package cbzip2
 
-import "io"
+import (
+	"io"
+	"runtime"
+)
 
 type Reader struct {
 	r      io.Reader
 	bz     bzip
 	in     []byte
 	skipIn bool
-	err    error
+	opts   ReaderOptions
+	// multistream continues decoding past the end of a bzip2 stream
+	multistream bool
+	// streamEnd is set when the current stream has been fully decoded
+	streamEnd bool
+	// prevIn and prevOut count the bytes of the streams before the
+	// current one, whose counters restart at 0, and prevBlocks the
+	// blocks in them
+	prevIn     int64
+	prevOut    int64
+	prevBlocks int
+	// index records the blocks decoded, if enabled
+	index *indexRecorder
+	// blocks decodes the input a block at a time instead of bz, for
+	// SkipCorrupt
+	blocks *ParallelReader
+	state  streamState
+	guard  useGuard
+	// copyBuf is the output buffer of WriteTo, kept for the next call
+	copyBuf []byte
+	err     error
+}
+
+// ReaderOptions controls the parameters handed to BZ2_bzDecompressInit.
+// The zero value uses the library defaults.
+type ReaderOptions struct {
+	// Small selects the alternative decompression algorithm, which uses
+	// roughly 2.3MB instead of 3.7MB per stream at about half the speed.
+	Small bool
+	// Verbosity is the libbzip2 trace level, between 0 (silent) and 4.
+	Verbosity int
+	// Log receives the trace output requested by Verbosity. If nil, it
+	// goes to the process's stderr.
+	Log io.Writer
+	// BuildIndex records the position of every block as it is decoded,
+	// see Reader.Index.
+	BuildIndex bool
+	// SkipCorrupt drops the blocks that fail to decode rather than
+	// failing the read, and carries on at the next block. The input is
+	// then split into blocks and each is decoded and checked before any of
+	// its data is returned, as by ParallelReader, with the other options
+	// applying to each block. The input is read ahead of the blocks
+	// returned, in the background from the moment the Reader is created
+	// until Close, which waits for a Read of it under way to return.
+	// Multistream(false) still ends the read at the end of the first
+	// stream, but not with the rest of the input unread.
+	SkipCorrupt bool
+	// OnSkip, if set, is called with each block dropped by SkipCorrupt.
+	OnSkip func(SkippedBlock)
+	// IgnoreSkipped makes Read return io.EOF at the end of the input even
+	// if blocks were dropped, rather than a *SkipError.
+	IgnoreSkipped bool
+	// MaxOutputBytes, if positive, is the most data the reader will
+	// produce. If the input holds more, Read returns the data up to the
+	// limit and then ErrLimitExceeded.
+	MaxOutputBytes int64
+	// MaxExpansionRatio, if positive, is the largest TotalOut / TotalIn
+	// the reader will accept. Read returns ErrLimitExceeded as soon as the
+	// output so far is larger than this many times the input consumed.
+	MaxExpansionRatio float64
+	// MemoryBudget, if positive, is the most memory libbzip2 may allocate
+	// for the stream. Most of it is only needed once the stream header has
+	// been read, so going over it makes Read rather than NewReaderOptions
+	// fail with ErrMem. See also SetMemoryLimit.
+	MemoryBudget int64
+	// PanicOnConcurrentUse makes a call that overlaps another on the same
+	// Reader panic, rather than return ErrConcurrentUse.
+	PanicOnConcurrentUse bool
+}
+
+// SkippedBlock describes a corrupt block dropped by a Reader with
+// SkipCorrupt set.
+type SkippedBlock struct {
+	// Block is the number of the block, counting from 1 across all the
+	// streams read.
+	Block int
+	// CompressedOffset is the offset of the start of the block in the
+	// input.
+	CompressedOffset int64
+	// EstimatedSize is a guess at the amount of data lost, from the size
+	// of the block and how well the blocks before it compressed.
+	EstimatedSize int64
 }
 
 // NewReader returns an io.ReadCloser. Reads from this are read from the
 // underlying io.Reader and decompressed via bzip2
 func NewReader(r io.Reader) (*Reader, error) {
-	rdr := &Reader{r: r, in: make([]byte, bufferLen)}
+	return NewReaderOptions(r, nil)
+}
 
-	if err := rdr.bz.decompressInit(verbosity, 0); err != nil {
+// NewReaderSmall is like NewReader but uses the low memory decompression
+// algorithm.
+func NewReaderSmall(r io.Reader) (*Reader, error) {
+	return NewReaderOptions(r, &ReaderOptions{Small: true})
+}
+
+// NewReaderOptions is like NewReader but decompresses with the given options.
+// A nil opts is equivalent to the zero ReaderOptions.
+func NewReaderOptions(r io.Reader, opts *ReaderOptions) (*Reader, error) {
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
+	rdr := &Reader{
+		r:           r,
+		in:          make([]byte, bufferLen),
+		opts:        *opts,
+		multistream: true,
+	}
+
+	if err := rdr.init(); err != nil {
 		return nil, err
 	}
+	runtime.SetFinalizer(rdr, (*Reader).finalize)
 	return rdr, nil
 }
 
-// Read pulls data up from the underlying io.Reader and decompresses the data
+// finalize frees the stream of a Reader that was never closed, or stops
+// the decoding of SkipCorrupt.
+func (r *Reader) finalize() {
+	if r.bz.active() {
+		logLeak("Reader")
+		_ = r.bz.endDecompress()
+	}
+	if r.blocks != nil && r.state != stateClosed {
+		logLeak("Reader")
+		// don't hold up the other finalizers for a read under way
+		r.blocks.stop()
+	}
+}
+
+func (r *Reader) init() error {
+	r.index = nil
+	if r.opts.BuildIndex {
+		r.index = &indexRecorder{}
+	}
+	if r.opts.SkipCorrupt {
+		return r.initBlocks()
+	}
+	hooks := newStreamHooks(r.opts.Log, r.index)
+	return r.bz.decompressInit(r.opts.Verbosity, boolToInt(r.opts.Small), hooks, r.opts.MemoryBudget)
+}
+
+// initBlocks sets up the block at a time decoding of SkipCorrupt.
+func (r *Reader) initBlocks() error {
+	// the blocks are decoded one at a time, like the C stream would, but
+	// a retry of a split block runs alongside the next one, so they
+	// share the log
+	decode := r.opts
+	if decode.Log != nil {
+		decode.Log = &lockedWriter{w: decode.Log}
+	}
+	pr, err := newParallelReader(r.r, &ParallelReaderOptions{Workers: 1}, &decode)
+	if err != nil {
+		return err
+	}
+	// the scanning goroutine can reach pr, which must not refer to r for
+	// an unclosed Reader to be finalized
+	pr.onSkip = r.opts.OnSkip
+	if pr.onSkip == nil {
+		pr.onSkip = func(SkippedBlock) {}
+	}
+	if r.index != nil {
+		pr.onBlock = r.index.idx.add
+	}
+	r.blocks = pr
+	return nil
+}
+
+// Reset discards the reader's state and makes it equivalent to the result
+// of its original constructor, but reading from rd instead. Multistream
+// is re-enabled. Only the Go buffers are reused: libbzip2 has no way to
+// reset a stream, so its state is freed and allocated again, as it would
+// be for the next stream of the input anyway.
+func (r *Reader) Reset(rd io.Reader) error {
+	_ = r.bz.endDecompress()
+	if r.blocks != nil {
+		r.blocks.Close()
+		r.blocks = nil
+	}
+	r.r = rd
+	r.skipIn = false
+	r.multistream = true
+	r.streamEnd = false
+	r.prevIn, r.prevOut, r.prevBlocks = 0, 0, 0
+	r.state = stateOpen
+	if r.err = r.init(); r.err != nil {
+		r.state = stateErrored
+	}
+	// drop whatever input was left over from the previous stream
+	r.bz.setInBuf(nil, 0)
+	return r.err
+}
+
+// Small reports whether the reader uses the low memory decompression
+// algorithm.
+func (r *Reader) Small() bool {
+	return r.opts.Small
+}
+
+// Multistream controls whether the reader supports concatenated bzip2
+// streams, as produced by pbzip2 or by concatenating .bz2 files.
+//
+// If enabled (the default), the reader decodes each stream in turn and
+// the output is the concatenation of all of them, just like the bzip2
+// command. If disabled, Read returns io.EOF at the end of the first
+// stream, leaving any remaining input unread in the reader's buffer.
+func (r *Reader) Multistream(ok bool) {
+	r.multistream = ok
+}
+
+// TotalIn returns the number of compressed bytes consumed so far, across
+// all streams.
+func (r *Reader) TotalIn() int64 {
+	if r.blocks != nil {
+		return r.blocks.in
+	}
+	return r.prevIn + r.bz.totalIn()
+}
+
+// TotalOut returns the number of decompressed bytes produced so far, across
+// all streams.
+func (r *Reader) TotalOut() int64 {
+	if r.blocks != nil {
+		// the rest of the current block has not been read yet
+		return r.blocks.total - int64(len(r.blocks.out))
+	}
+	return r.prevOut + r.bz.totalOut()
+}
+
+// MemoryInUse returns the number of bytes libbzip2 currently has allocated
+// for the reader.
+func (r *Reader) MemoryInUse() int64 {
+	return r.bz.memory()
+}
+
+// CompressionRatio returns TotalOut / TotalIn, or 0 if nothing has been
+// consumed yet.
+func (r *Reader) CompressionRatio() float64 {
+	return ratio(r.TotalOut(), r.TotalIn())
+}
+
+// Index returns the blocks decoded so far, if the reader was created with
+// BuildIndex set, and nil otherwise. Once the whole input has been read,
+// it is the same Index as BuildIndex would return, without a second pass.
+func (r *Reader) Index() *Index {
+	if r.index == nil {
+		return nil
+	}
+	idx := r.index.idx
+	return &idx
+}
+
+// Read pulls data up from the underlying io.Reader and decompresses the data.
+// If the underlying io.Reader ends before the end of stream marker, Read
+// returns an *Error wrapping io.ErrUnexpectedEOF, with the amount of input
+// consumed and output decoded until then. Once Read has returned an error it returns
+// it again on every call, and ErrClosed after Close.
+//
+// A Reader is not safe for concurrent use: a Read, WriteTo or Close that
+// overlaps another fails with ErrConcurrentUse.
 func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.guard.enter("Reader", r.opts.PanicOnConcurrentUse); err != nil {
+		return 0, err
+	}
+	defer r.guard.exit()
+	return r.read(p)
+}
+
+// read is Read, without the guard.
+func (r *Reader) read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
+	if r.blocks != nil {
+		return r.readBlocks(p)
+	}
+	if max := r.opts.MaxOutputBytes; max > 0 {
+		// decoding a byte past the limit is enough to tell it was crossed
+		if left := max - r.TotalOut(); int64(len(p)) > left+1 {
+			p = p[:left+1]
+		}
+	}
 	// read and deflate until the output buffer is full
 	r.bz.setOutBuf(p, len(p))
 	for {
+		// the first stream may have ended in a call that produced no
+		// output, stop before reading any of the next
+		if r.streamEnd && !r.multistream {
+			return 0, r.end(io.EOF)
+		}
 		// if the amount of available data to read is 0
 		// we reach to the wrapped reader to get more data
 		// otherwise, we compress what data is already available
@@ -36,10 +310,21 @@ func (r *Reader) Read(p []byte) (int, error) {
 			var n int
 			n, r.err = r.r.Read(r.in)
 
-			// we are done with reading
+			// we are done with reading, which is only expected
+			// once the end of stream marker has been decoded.
+			// everything decoded up to this point has already
+			// been returned to the caller.
 			if n == 0 && r.err == io.EOF {
-				_ = r.bz.endDecompress()
-				return n, r.err
+				if !r.streamEnd {
+					r.err = &Error{
+						Op:                 opDecompress,
+						Code:               BZ_UNEXPECTED_EOF,
+						CompressedOffset:   r.TotalIn(),
+						UncompressedOffset: r.TotalOut(),
+						Err:                io.ErrUnexpectedEOF,
+					}
+				}
+				return n, r.end(r.err)
 			}
 
 			// we have data, and EOF
@@ -50,8 +335,7 @@ func (r *Reader) Read(p []byte) (int, error) {
 			}
 			if n == 0 && r.err != nil {
 				// if we don't have any data and we errored, close and return
-				_ = r.bz.endDecompress()
-				return 0, r.err
+				return 0, r.end(r.err)
 			}
 			// if we do have an error, but we read data, we want to process it
 			// and return the error at the bottom
@@ -59,9 +343,34 @@ func (r *Reader) Read(p []byte) (int, error) {
 		} else {
 			r.skipIn = false // try again
 		}
-		ret := r.bz.decompress()
-		if ret < 0 {
-			r.err = retCodeToErr(int(ret))
+		// the previous stream has ended but there is more input,
+		// start over on the next one
+		if r.streamEnd {
+			r.prevIn += r.bz.totalIn()
+			r.prevOut += r.bz.totalOut()
+			r.prevBlocks += r.bz.blocks()
+			if r.index != nil {
+				r.index.inBase, r.index.outBase = 8*r.prevIn, r.prevOut
+			}
+			if err := r.bz.restartDecompress(r.opts.Verbosity, boolToInt(r.opts.Small)); err != nil {
+				return 0, r.end(err)
+			}
+			r.streamEnd = false
+		}
+		ret, err := r.bz.decompress()
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				// the stream only knows about itself
+				e.CompressedOffset += r.prevIn
+				e.UncompressedOffset += r.prevOut
+				if e.Block > 0 {
+					e.Block += r.prevBlocks
+				}
+			}
+			r.err = err
+		}
+		if ret == BZ_STREAM_END {
+			r.streamEnd = true
 		}
 		// check if we've read anything, if so, return it.
 		have := len(p) - int(r.bz.availOut())
@@ -69,17 +378,81 @@ func (r *Reader) Read(p []byte) (int, error) {
 			// if the there is no output buffer and we returned OK
 			// we want to skip the next read
 			r.skipIn = (ret == BZ_OK && r.bz.availOut() == 0)
+			if n, err := r.checkLimits(have); err != nil {
+				have, r.err = n, err
+			}
+			if r.err != nil {
+				// nothing more can be read, release the stream now
+				r.end(r.err)
+			}
 			return have, r.err
 		}
 	}
 }
 
-// Close closes the reader, but not the underlying io.Reader
+// readBlocks is Read for SkipCorrupt.
+func (r *Reader) readBlocks(p []byte) (int, error) {
+	r.blocks.single = !r.multistream
+	n, err := r.blocks.Read(p)
+	if m, lerr := r.checkLimits(n); lerr != nil {
+		n, err = m, lerr
+	}
+	if err == io.EOF && len(r.blocks.dropped) > 0 && !r.opts.IgnoreSkipped {
+		err = &SkipError{Skipped: r.blocks.dropped}
+	}
+	if err != nil {
+		r.end(err)
+	}
+	return n, err
+}
+
+// end stops the reader with err, releasing the stream. io.EOF leaves it
+// finished, anything else errored.
+func (r *Reader) end(err error) error {
+	r.err = err
+	r.state = stateErrored
+	if err == io.EOF {
+		r.state = stateFinished
+	}
+	_ = r.bz.endDecompress()
+	return err
+}
+
+// checkLimits returns ErrLimitExceeded if the output so far crosses
+// MaxOutputBytes or MaxExpansionRatio, with n, the amount just read, cut
+// back to what the limits allow.
+func (r *Reader) checkLimits(n int) (int, error) {
+	out, in := r.TotalOut(), r.TotalIn()
+	if max := r.opts.MaxOutputBytes; max > 0 && out > max {
+		return n - int(out-max), ErrLimitExceeded
+	}
+	if max := r.opts.MaxExpansionRatio; max > 0 && float64(out) > max*float64(in) {
+		return n, ErrLimitExceeded
+	}
+	return n, nil
+}
+
+// Close closes the reader, but not the underlying io.Reader, which is no
+// longer used once it returns. It returns the error that stopped Read, if
+// any, and ErrClosed if the reader is already closed.
 func (r *Reader) Close() error {
-	if r.err != nil {
-		return r.err
+	if err := r.guard.enter("Reader", r.opts.PanicOnConcurrentUse); err != nil {
+		return err
+	}
+	defer r.guard.exit()
+	if r.state == stateClosed {
+		return ErrClosed
+	}
+	if r.blocks != nil {
+		// stop the scanner, however the read ended
+		r.blocks.Close()
 	}
 	_ = r.bz.endDecompress()
-	r.err = io.EOF
-	return nil
+	var err error
+	if r.state == stateErrored {
+		err = r.err
+	}
+	r.state = stateClosed
+	r.err = ErrClosed
+	return err
 }
@@ -4,9 +4,16 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestBasicDecompress(t *testing.T) {
@@ -48,11 +55,12 @@ func TestBasicDecompress(t *testing.T) {
 			if err != nil {
 				t.Fatalf("error reading from bzip decoder: %s", err)
 			}
-			if !reflect.DeepEqual(v.want, out.Bytes()) {
+			// WriteTo never writes an empty output, leaving out.Bytes() nil
+			if !bytes.Equal(v.want, out.Bytes()) {
 				t.Fatalf("bzip2 output did not match expected")
 			}
 		} else {
-			if err != v.wantErr {
+			if !errors.Is(err, v.wantErr) {
 				t.Fatalf("wanted err: %s, got: %s", v.wantErr, err)
 			}
 		}
@@ -160,3 +168,588 @@ func (sr *specialReader) Read(p []byte) (int, error) {
 	sr.t.Logf("Sending %v bytes", toCopy)
 	return toCopy, nil
 }
+
+func TestSmallDecompress(t *testing.T) {
+	var raw bytes.Buffer
+	_, err := io.CopyN(&raw, rand.Reader, 256*1024)
+	if err != nil {
+		t.Fatalf("error generating random data: %s", err)
+	}
+	var compressed bytes.Buffer
+	cmprsr, err := NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	if _, err := cmprsr.Write(raw.Bytes()); err != nil {
+		t.Fatalf("error compressing random data: %s", err)
+	}
+	if err := cmprsr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	rdr, err := NewReaderSmall(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if !rdr.Small() {
+		t.Fatal("reader created with NewReaderSmall does not report small mode")
+	}
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, rdr); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if !reflect.DeepEqual(raw.Bytes(), out.Bytes()) {
+		t.Fatal("data decompressed in small mode did not match")
+	}
+}
+
+func TestReaderLog(t *testing.T) {
+	var compressed bytes.Buffer
+	cmprsr, err := NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	if _, err := cmprsr.Write(bytes.Repeat([]byte("hello, world "), 1024)); err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	if err := cmprsr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	var log bytes.Buffer
+	rdr, err := NewReaderOptions(&compressed, &ReaderOptions{Verbosity: 3, Log: &log})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if _, err := io.Copy(io.Discard, rdr); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if !bytes.Contains(log.Bytes(), []byte("combined CRCs: stored = 0x")) {
+		t.Fatalf("expected combined CRC trace in log output, got: %q", log.String())
+	}
+}
+
+func TestMultistream(t *testing.T) {
+	var raw, compressed bytes.Buffer
+	for i := 0; i < 3; i++ {
+		var part bytes.Buffer
+		_, err := io.CopyN(&part, rand.Reader, int64(10*1024*(i+1)))
+		if err != nil {
+			t.Fatalf("error generating random data: %s", err)
+		}
+		raw.Write(part.Bytes())
+		cmprsr, err := NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("unable to make bzip compressor: %s", err)
+		}
+		if _, err := cmprsr.Write(part.Bytes()); err != nil {
+			t.Fatalf("error compressing random data: %s", err)
+		}
+		if err := cmprsr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+	}
+
+	rdr, err := NewReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, rdr); err != nil {
+		t.Fatalf("error decompressing concatenated streams: %s", err)
+	}
+	if !reflect.DeepEqual(raw.Bytes(), out.Bytes()) {
+		t.Fatal("concatenated streams did not decompress to the concatenated input")
+	}
+
+	rdr, err = NewReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	rdr.Multistream(false)
+	out.Reset()
+	if _, err := io.Copy(&out, rdr); err != nil {
+		t.Fatalf("error decompressing first stream: %s", err)
+	}
+	if !reflect.DeepEqual(raw.Bytes()[:10*1024], out.Bytes()) {
+		t.Fatal("single stream mode did not stop at the end of the first stream")
+	}
+
+	// the end of the stream comes in a call without output
+	first, err := Compress(nil, raw.Bytes()[:10*1024], nil)
+	if err != nil {
+		t.Fatalf("error compressing random data: %s", err)
+	}
+	src := bytes.NewReader(compressed.Bytes())
+	rdr, err = NewReader(iotest.OneByteReader(src))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	rdr.Multistream(false)
+	out.Reset()
+	if _, err := io.Copy(&out, rdr); err != nil {
+		t.Fatalf("error decompressing first stream: %s", err)
+	}
+	if !reflect.DeepEqual(raw.Bytes()[:10*1024], out.Bytes()) {
+		t.Fatal("single stream mode did not stop at the end of the first stream")
+	}
+	if left := compressed.Len() - len(first); src.Len() != left {
+		t.Fatalf("wanted %d bytes left unread, got %d", left, src.Len())
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var raw, compressed bytes.Buffer
+	_, err := io.CopyN(&raw, rand.Reader, 64*1024)
+	if err != nil {
+		t.Fatalf("error generating random data: %s", err)
+	}
+	cmprsr, err := NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("unable to make bzip compressor: %s", err)
+	}
+	if _, err := cmprsr.Write(raw.Bytes()); err != nil {
+		t.Fatalf("error compressing random data: %s", err)
+	}
+	if err := cmprsr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	for _, cut := range []int{0, 4, compressed.Len() / 2, compressed.Len() - 1} {
+		t.Logf("truncating compressed data to %d bytes", cut)
+		rdr, err := NewReader(bytes.NewReader(compressed.Bytes()[:cut]))
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		n, err := io.Copy(io.Discard, rdr)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("wanted err: %v, got: %v", io.ErrUnexpectedEOF, err)
+		}
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("wanted *Error, got: %T", err)
+		}
+		if e.CompressedOffset != int64(cut) || e.UncompressedOffset != n {
+			t.Fatalf("wanted offsets %d and %d, got: %v", cut, n, e)
+		}
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	var streams [][]byte
+	for _, msg := range []string{"first stream", "second stream"} {
+		var compressed bytes.Buffer
+		cmprsr, err := NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("unable to make bzip compressor: %s", err)
+		}
+		if _, err := cmprsr.Write([]byte(msg)); err != nil {
+			t.Fatalf("error compressing data: %s", err)
+		}
+		if err := cmprsr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+		streams = append(streams, compressed.Bytes())
+	}
+	rdr, err := NewReader(bytes.NewReader(streams[0]))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	// abandon the first stream part way through
+	if _, err := rdr.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if err := rdr.Reset(bytes.NewReader(streams[1])); err != nil {
+		t.Fatalf("error resetting reader: %s", err)
+	}
+	out, err := io.ReadAll(rdr)
+	if err != nil {
+		t.Fatalf("error decompressing data after reset: %s", err)
+	}
+	if string(out) != "second stream" {
+		t.Fatalf("reset reader produced %q", out)
+	}
+	if err := rdr.Reset(bytes.NewReader(streams[0])); err != nil {
+		t.Fatalf("error resetting reader: %s", err)
+	}
+	out, err = io.ReadAll(rdr)
+	if err != nil {
+		t.Fatalf("error decompressing data after reset: %s", err)
+	}
+	if string(out) != "first stream" {
+		t.Fatalf("reset reader produced %q", out)
+	}
+}
+
+func TestReaderTotals(t *testing.T) {
+	var compressed bytes.Buffer
+	data := bytes.Repeat([]byte("hello, world "), 4096)
+	for i := 0; i < 2; i++ {
+		cmprsr, err := NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("unable to make bzip compressor: %s", err)
+		}
+		if _, err := cmprsr.Write(data); err != nil {
+			t.Fatalf("error compressing data: %s", err)
+		}
+		if err := cmprsr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+	}
+	rdr, err := NewReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if rdr.CompressionRatio() != 0 {
+		t.Fatal("expected a ratio of 0 before any data is read")
+	}
+	if _, err := io.Copy(io.Discard, rdr); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	if got := rdr.TotalIn(); got != int64(compressed.Len()) {
+		t.Fatalf("wanted TotalIn %d, got %d", compressed.Len(), got)
+	}
+	if got := rdr.TotalOut(); got != int64(2*len(data)) {
+		t.Fatalf("wanted TotalOut %d, got %d", 2*len(data), got)
+	}
+}
+
+func TestSkipCorrupt(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	lost := idx.Blocks[2]
+	damaged := append([]byte{}, compressed...)
+	damaged[(lost.CompressedOffset+lost.CompressedBits/2)/8] ^= 0xff
+	want := append(append([]byte{}, raw[:lost.UncompressedOffset]...), raw[lost.UncompressedOffset+lost.UncompressedSize:]...)
+
+	tt := []struct {
+		msg     string
+		opts    ReaderOptions
+		wantErr bool
+	}{
+		{msg: "skip", opts: ReaderOptions{SkipCorrupt: true}, wantErr: true},
+		{msg: "skip and ignore", opts: ReaderOptions{SkipCorrupt: true, IgnoreSkipped: true}},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		var skipped []SkippedBlock
+		v.opts.OnSkip = func(b SkippedBlock) { skipped = append(skipped, b) }
+		rdr, err := NewReaderOptions(bytes.NewReader(damaged), &v.opts)
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		var out bytes.Buffer
+		_, err = io.Copy(&out, rdr)
+		rdr.Close()
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Fatal("data around the corrupt block did not match")
+		}
+		if len(skipped) != 1 || skipped[0].Block != 3 || skipped[0].CompressedOffset != lost.CompressedOffset/8 || skipped[0].EstimatedSize <= 0 {
+			t.Fatalf("unexpected skipped blocks: %+v", skipped)
+		}
+		if !v.wantErr {
+			if err != nil {
+				t.Fatalf("error reading from bzip decoder: %s", err)
+			}
+			continue
+		}
+		var se *SkipError
+		if !errors.As(err, &se) || !errors.Is(err, ErrBadData) || !reflect.DeepEqual(se.Skipped, skipped) {
+			t.Fatalf("wanted a *SkipError, got: %v", err)
+		}
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	zeros, err := Compress(nil, make([]byte, 10*1024*1024), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	var random bytes.Buffer
+	if _, err := io.CopyN(&random, rand.Reader, 1024*1024); err != nil {
+		t.Fatalf("error generating random data: %s", err)
+	}
+	noise, err := Compress(nil, random.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	tt := []struct {
+		msg     string
+		data    []byte
+		opts    ReaderOptions
+		want    int64
+		wantErr error
+	}{
+		{msg: "output limit", data: zeros, opts: ReaderOptions{MaxOutputBytes: 1000003}, want: 1000003, wantErr: ErrLimitExceeded},
+		{msg: "output limit met exactly", data: zeros, opts: ReaderOptions{MaxOutputBytes: 10 * 1024 * 1024}, want: 10 * 1024 * 1024},
+		{msg: "output limit skipping corrupt blocks", data: zeros, opts: ReaderOptions{MaxOutputBytes: 1000003, SkipCorrupt: true}, want: 1000003, wantErr: ErrLimitExceeded},
+		{msg: "expansion ratio", data: zeros, opts: ReaderOptions{MaxExpansionRatio: 1000}, wantErr: ErrLimitExceeded},
+		{msg: "expansion ratio not reached", data: noise, opts: ReaderOptions{MaxExpansionRatio: 2}, want: 1024 * 1024},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		rdr, err := NewReaderOptions(bytes.NewReader(v.data), &v.opts)
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		n, err := io.Copy(io.Discard, rdr)
+		rdr.Close()
+		if err != v.wantErr {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, err)
+		}
+		if v.want > 0 && n != v.want {
+			t.Fatalf("wanted %d bytes, got %d", v.want, n)
+		}
+	}
+}
+
+func TestReaderLifecycle(t *testing.T) {
+	compressed, err := Compress(nil, []byte("hello, world"), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	rdr, err := NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if _, err := io.ReadAll(rdr); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	// the stream is released as soon as it has been read
+	if rdr.MemoryInUse() != 0 {
+		t.Fatalf("memory still in use at EOF: %d", rdr.MemoryInUse())
+	}
+	if _, err := rdr.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("wanted err: %v, got: %v", io.EOF, err)
+	}
+	if err := rdr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 reader: %s", err)
+	}
+	if _, err := rdr.Read(make([]byte, 1)); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+	if err := rdr.Close(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+
+	// a failed read is reported again by Close
+	if err := rdr.Reset(bytes.NewReader(compressed[:len(compressed)/2])); err != nil {
+		t.Fatalf("error resetting reader: %s", err)
+	}
+	_, readErr := io.ReadAll(rdr)
+	if !errors.Is(readErr, io.ErrUnexpectedEOF) {
+		t.Fatalf("wanted err: %v, got: %v", io.ErrUnexpectedEOF, readErr)
+	}
+	if err := rdr.Close(); err != readErr {
+		t.Fatalf("wanted err: %v, got: %v", readErr, err)
+	}
+	if err := rdr.Close(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+}
+
+// blockingReader holds up its first Read until release is closed, closing
+// entered once it has been called.
+type blockingReader struct {
+	r       io.Reader
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingReader(b []byte) *blockingReader {
+	return &blockingReader{r: bytes.NewReader(b), entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	br.once.Do(func() {
+		close(br.entered)
+		<-br.release
+	})
+	return br.r.Read(p)
+}
+
+func TestReaderConcurrentUse(t *testing.T) {
+	compressed, err := Compress(nil, []byte("hello, world"), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	for _, panics := range []bool{false, true} {
+		t.Logf("test: PanicOnConcurrentUse %v", panics)
+		br := newBlockingReader(compressed)
+		rdr, err := NewReaderOptions(br, &ReaderOptions{PanicOnConcurrentUse: panics})
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		done := make(chan error)
+		go func() {
+			out, err := io.ReadAll(rdr)
+			if err == nil && string(out) != "hello, world" {
+				err = fmt.Errorf("read %q", out)
+			}
+			done <- err
+		}()
+		<-br.entered
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != panics {
+					t.Fatalf("wanted panic: %v, got: %v", panics, r)
+				}
+			}()
+			if _, err := rdr.Read(make([]byte, 1)); err != ErrConcurrentUse {
+				t.Fatalf("wanted err: %v, got: %v", ErrConcurrentUse, err)
+			}
+		}()
+		close(br.release)
+		// the call already running is unaffected
+		if err := <-done; err != nil {
+			t.Fatalf("error decompressing data: %s", err)
+		}
+		if err := rdr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 reader: %s", err)
+		}
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatalf("error creating file: %s", err)
+	}
+	defer f.Close()
+	tt := []struct {
+		msg string
+		w   io.Writer
+	}{
+		{msg: "buffer", w: &bytes.Buffer{}},
+		{msg: "file", w: f},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		rdr, err := NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		n, err := rdr.WriteTo(v.w)
+		if err != nil {
+			t.Fatalf("error decompressing data: %s", err)
+		}
+		if n != int64(len(raw)) || n != rdr.TotalOut() {
+			t.Fatalf("wanted %d bytes, got %d, TotalOut %d", len(raw), n, rdr.TotalOut())
+		}
+		if err := rdr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 reader: %s", err)
+		}
+	}
+	if got := tt[0].w.(*bytes.Buffer).Bytes(); !bytes.Equal(got, raw) {
+		t.Fatal("data written to the buffer did not match")
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("error reading file: %s", err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Fatal("data written to the file did not match")
+	}
+
+	// what could not be written is lost, the reader stops there
+	fail := errors.New("broken pipe")
+	rdr, err := NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	n, err := rdr.WriteTo(&failWriter{n: 1000, err: fail})
+	if err != fail || n != 1000 {
+		t.Fatalf("wanted 1000 bytes and err: %v, got %d and err: %v", fail, n, err)
+	}
+	if err := rdr.Close(); err != fail {
+		t.Fatalf("wanted err: %v, got: %v", fail, err)
+	}
+}
+
+func TestSkipCorruptOptions(t *testing.T) {
+	raw, compressed := multiBlock(t)
+
+	// the options apply to each block
+	var log bytes.Buffer
+	rdr, err := NewReaderOptions(bytes.NewReader(compressed), &ReaderOptions{SkipCorrupt: true, Small: true, Verbosity: 2, Log: &log})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if out, err := io.ReadAll(rdr); err != nil || !bytes.Equal(out, raw) {
+		t.Fatalf("error decompressing data: %v", err)
+	}
+	rdr.Close()
+	if log.Len() == 0 {
+		t.Fatal("wanted trace output in the log")
+	}
+	var skipped []SkippedBlock
+	rdr, err = NewReaderOptions(bytes.NewReader(compressed), &ReaderOptions{
+		SkipCorrupt:  true,
+		MemoryBudget: 100 * 1024,
+		OnSkip:       func(b SkippedBlock) { skipped = append(skipped, b) },
+	})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	// running out of memory is not corruption
+	if _, err := io.ReadAll(rdr); !errors.Is(err, ErrMem) || len(skipped) > 0 {
+		t.Fatalf("wanted err: %v and no skipped blocks, got: %v and %+v", ErrMem, err, skipped)
+	}
+	rdr.Close()
+
+	// only the first of two streams is read
+	second, err := Compress(nil, []byte("second stream"), nil)
+	if err != nil {
+		t.Fatalf("error compressing data: %s", err)
+	}
+	rdr, err = NewReaderOptions(bytes.NewReader(append(append([]byte{}, compressed...), second...)), &ReaderOptions{SkipCorrupt: true})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	rdr.Multistream(false)
+	if out, err := io.ReadAll(rdr); err != nil || !bytes.Equal(out, raw) {
+		t.Fatalf("wanted the first stream only, got %d bytes, err: %v", len(out), err)
+	}
+	rdr.Close()
+}
+
+func TestSkipCorruptFinalizer(t *testing.T) {
+	_, compressed := multiBlock(t)
+	rdr, err := NewReaderOptions(bytes.NewReader(compressed), &ReaderOptions{SkipCorrupt: true})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	if _, err := rdr.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("error decompressing data: %s", err)
+	}
+	// the reader is dropped without Close, its decoding must still stop
+	pr := rdr.blocks
+	rdr = nil
+	for i := 0; i < 50; i++ {
+		runtime.GC()
+		select {
+		case <-pr.quit:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("an unclosed SkipCorrupt reader was never finalized")
+}
+
+func BenchmarkReader(b *testing.B) {
+	raw, compressed := multiBlock(b)
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rdr, err := NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			b.Fatalf("unable to make bzip decompressor: %s", err)
+		}
+		if _, err := io.Copy(io.Discard, rdr); err != nil {
+			b.Fatalf("error decompressing data: %s", err)
+		}
+		rdr.Close()
+	}
+}
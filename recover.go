@@ -0,0 +1,157 @@
+package cbzip2
+
+import "io"
+
+// RecoveryReport describes what Recover found in a damaged input.
+type RecoveryReport struct {
+	// Recovered is the number of intact blocks, and Bytes the amount of
+	// uncompressed data in them.
+	Recovered int
+	Bytes     int64
+	// Lost lists the damaged regions of the input, in order.
+	Lost []LostRange
+}
+
+// LostRange is a region of the input whose blocks could not be decoded.
+type LostRange struct {
+	// CompressedOffset and CompressedBits locate the damaged data in the
+	// input, in bits.
+	CompressedOffset int64
+	CompressedBits   int64
+	// UncompressedOffset is where the lost data belongs in the recovered
+	// data. If nothing was lost before, it is also its offset in the
+	// original data.
+	UncompressedOffset int64
+	// EstimatedSize guesses how much data was lost, from how well the
+	// blocks before it compressed, as for SkippedBlock. The length of a
+	// block is only found by decoding it.
+	EstimatedSize int64
+}
+
+// Recover salvages the intact blocks of a damaged sequence of bzip2 streams
+// read from src, like bzip2recover. Every block found is decoded on its own
+// to check its CRC, and the good ones are written to dst as a single new
+// stream, which decompresses to the recoverable data. It is written with a
+// block size of 9, since that of a damaged stream can't be trusted.
+//
+// The returned report lists the regions that were lost. An error is only
+// returned if reading src or writing dst fails.
+func Recover(dst io.Writer, src io.Reader) (*RecoveryReport, error) {
+	w := &bitWriter{}
+	w.buf = append(w.buf, 'B', 'Z', 'h', '0'+blockSize)
+	var combined uint32
+	report, err := recoverBlocks(src, func(segs []*blockSegment, _ []byte) error {
+		for _, seg := range segs {
+			w.writeSegment(seg)
+		}
+		combined = combineCRC(combined, segs[0].crc)
+		// hand out the whole bytes written so far
+		_, err := dst.Write(w.buf)
+		w.buf = w.buf[:0]
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	w.writeBits(eosMagic>>24, 24)
+	w.writeBits(eosMagic&(1<<24-1), 24)
+	w.writeBits(uint64(combined), crcBits)
+	_, err = dst.Write(w.bytes())
+	return report, err
+}
+
+// RecoverSplit is like Recover, but writes each intact block as a stream of
+// its own, like the rec00001file.bz2 files of bzip2recover. create is called
+// with the number of the block, counting from 1, and the writer it returns
+// is closed once the block has been written.
+func RecoverSplit(src io.Reader, create func(block int) (io.WriteCloser, error)) (*RecoveryReport, error) {
+	n := 0
+	return recoverBlocks(src, func(segs []*blockSegment, _ []byte) error {
+		n++
+		w, err := create(n)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(singleBlockStream(segs...)); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// recoverBlocks scans src for blocks and calls fn with each one that
+// decodes, joining segments split by a magic number in the block data.
+func recoverBlocks(src io.Reader, fn func(segs []*blockSegment, out []byte) error) (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+	s := newBlockScanner(src)
+	s.lenient = true
+	var queue []*blockSegment
+	// the input that went into the recovered blocks, in bits
+	var inBits int64
+	eof := false
+	for {
+		// keep enough segments to join a split block
+		for !eof && len(queue) < maxSplitSegments {
+			ev, err := s.next()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return report, err
+			}
+			if ev.block != nil {
+				queue = append(queue, ev.block)
+			}
+		}
+		if len(queue) == 0 {
+			return report, nil
+		}
+
+		var out []byte
+		var err error
+		n := 0
+		for n < len(queue) {
+			n++
+			if out, err = decodeBlock(nil, queue[:n]...); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			// only the first segment is known to be bad, the rest may
+			// still be blocks of their own
+			report.lose(queue[0], report.Bytes, estimateLost(queue[0], report.Bytes, inBits))
+			queue = queue[1:]
+			continue
+		}
+		if err := fn(queue[:n], out); err != nil {
+			return report, err
+		}
+		report.Recovered++
+		report.Bytes += int64(len(out))
+		for _, seg := range queue[:n] {
+			inBits += seg.nbits
+		}
+		queue = queue[n:]
+	}
+}
+
+// lose adds seg, thought to have held size bytes, to the lost regions,
+// merging it with the previous one if they are adjacent.
+func (r *RecoveryReport) lose(seg *blockSegment, out, size int64) {
+	if n := len(r.Lost); n > 0 {
+		last := &r.Lost[n-1]
+		if last.CompressedOffset+last.CompressedBits == seg.offset {
+			last.CompressedBits += seg.nbits
+			last.EstimatedSize += size
+			return
+		}
+	}
+	r.Lost = append(r.Lost, LostRange{
+		CompressedOffset:   seg.offset,
+		CompressedBits:     seg.nbits,
+		UncompressedOffset: out,
+		EstimatedSize:      size,
+	})
+}
@@ -0,0 +1,123 @@
+package cbzip2
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestRecover(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	lost := idx.Blocks[2]
+	damaged := append([]byte{}, compressed...)
+	damaged[(lost.CompressedOffset+lost.CompressedBits/2)/8] ^= 0xff
+	// the rest of the data is expected to survive
+	// cut the input short in the middle of the last block
+	last := idx.Blocks[len(idx.Blocks)-1]
+	cut := (last.CompressedOffset + last.CompressedBits/2) / 8
+	want := append(append([]byte{}, raw[:lost.UncompressedOffset]...), raw[lost.UncompressedOffset+lost.UncompressedSize:]...)
+
+	tt := []struct {
+		msg       string
+		data      []byte
+		want      []byte
+		recovered int
+		lost      []LostRange
+	}{
+		{msg: "intact", data: compressed, want: raw, recovered: len(idx.Blocks)},
+		{
+			msg: "damaged block", data: damaged, want: want, recovered: len(idx.Blocks) - 1,
+			lost: []LostRange{{CompressedOffset: lost.CompressedOffset, CompressedBits: lost.CompressedBits, UncompressedOffset: lost.UncompressedOffset}},
+		},
+		{
+			msg: "damaged header", data: append([]byte("XXXX"), compressed[4:]...), want: raw,
+			recovered: len(idx.Blocks),
+		},
+		{
+			msg: "truncated", data: compressed[:cut], want: raw[:last.UncompressedOffset],
+			recovered: len(idx.Blocks) - 1,
+			lost: []LostRange{{
+				CompressedOffset:   last.CompressedOffset,
+				CompressedBits:     8*cut - last.CompressedOffset,
+				UncompressedOffset: last.UncompressedOffset,
+			}},
+		},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		var out bytes.Buffer
+		report, err := Recover(&out, bytes.NewReader(v.data))
+		if err != nil {
+			t.Fatalf("error recovering data: %s", err)
+		}
+		// the size of a lost block is only a guess, checked below
+		for i, l := range report.Lost {
+			if l.EstimatedSize <= 0 || l.EstimatedSize > 100000 {
+				t.Fatalf("unexpected estimate of the data lost: %+v", l)
+			}
+			report.Lost[i].EstimatedSize = 0
+		}
+		if report.Recovered != v.recovered || report.Bytes != int64(len(v.want)) || !reflect.DeepEqual(report.Lost, v.lost) {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+		got, err := Decompress(nil, out.Bytes())
+		if err != nil {
+			t.Fatalf("error decompressing recovered data: %s", err)
+		}
+		if !bytes.Equal(got, v.want) {
+			t.Fatal("recovered data did not match")
+		}
+	}
+
+	// the estimate of what was lost is the same as SkipCorrupt's
+	report, err := Recover(io.Discard, bytes.NewReader(damaged))
+	if err != nil {
+		t.Fatalf("error recovering data: %s", err)
+	}
+	var skipped []SkippedBlock
+	rdr, err := NewReaderOptions(bytes.NewReader(damaged), &ReaderOptions{
+		SkipCorrupt: true,
+		OnSkip:      func(b SkippedBlock) { skipped = append(skipped, b) },
+	})
+	if err != nil {
+		t.Fatalf("unable to make bzip decompressor: %s", err)
+	}
+	io.Copy(io.Discard, rdr)
+	rdr.Close()
+	if len(skipped) != 1 || len(report.Lost) != 1 || report.Lost[0].EstimatedSize != skipped[0].EstimatedSize {
+		t.Fatalf("wanted the estimate of %+v, got: %+v", skipped, report.Lost)
+	}
+
+	var blocks []*bytes.Buffer
+	report, err = RecoverSplit(bytes.NewReader(damaged), func(n int) (io.WriteCloser, error) {
+		if n != len(blocks)+1 {
+			t.Fatalf("wanted block %d, got %d", len(blocks)+1, n)
+		}
+		blocks = append(blocks, new(bytes.Buffer))
+		return nopCloser{blocks[n-1]}, nil
+	})
+	if err != nil {
+		t.Fatalf("error recovering data: %s", err)
+	}
+	if len(blocks) != report.Recovered {
+		t.Fatalf("wanted %d files, got %d", report.Recovered, len(blocks))
+	}
+	var got []byte
+	for _, b := range blocks {
+		if got, err = Decompress(got, b.Bytes()); err != nil {
+			t.Fatalf("error decompressing recovered block: %s", err)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("recovered blocks did not match")
+	}
+}
@@ -0,0 +1,42 @@
+package cbzip2
+
+import "sync/atomic"
+
+// streamState is where a Reader or Writer is in its life. The C stream is
+// only held while it is open: it is released exactly once, on the way to
+// any of the other states.
+type streamState int
+
+const (
+	// stateOpen is a usable stream
+	stateOpen streamState = iota
+	// stateFinished is a Reader that has decoded all of its input
+	stateFinished
+	// stateErrored has a sticky error, returned by every call until Close
+	stateErrored
+	// stateClosed has been closed, every call but Reset returns ErrClosed
+	stateClosed
+)
+
+// useGuard detects overlapping calls on a Reader or Writer, which would
+// otherwise drive the same C stream from two threads at once.
+type useGuard struct {
+	busy atomic.Bool
+}
+
+// enter marks the start of a call, failing with ErrConcurrentUse, or
+// panicking if panics is set, when another call is still running.
+func (g *useGuard) enter(what string, panics bool) error {
+	if g.busy.CompareAndSwap(false, true) {
+		return nil
+	}
+	if panics {
+		panic("cbzip2: concurrent use of " + what)
+	}
+	return ErrConcurrentUse
+}
+
+// exit marks the end of a call started by a successful enter.
+func (g *useGuard) exit() {
+	g.busy.Store(false)
+}
@@ -0,0 +1,139 @@
+package cbzip2
+
+import (
+	"errors"
+	"io"
+)
+
+// verifyBufferLen is the size of the input and scratch output buffers of
+// Verify, larger than bufferLen to make fewer calls into libbzip2.
+const verifyBufferLen = 1024 * 1024
+
+// VerifyResult summarises the data checked by Verify.
+type VerifyResult struct {
+	// Streams and Blocks count the streams and blocks whose CRCs were
+	// found to be correct.
+	Streams int
+	Blocks  int
+	// Size is the amount of uncompressed data in them.
+	Size int64
+	// TrailingGarbage is the length of the data after the last stream
+	// that does not start another one. Like bzip2 -t, it is ignored once
+	// a stream has been checked.
+	TrailingGarbage int64
+}
+
+// Verify checks the integrity of the bzip2 data read from r, which may hold
+// several concatenated streams, like bzip2 -t. Every block CRC and the
+// combined CRC of every stream are checked, decoding into a scratch buffer
+// rather than handing the data out.
+//
+// The result covers what was checked before the first error, which is
+// returned as an *Error locating it if the data is corrupt. If r ends
+// before the end of a stream, the *Error wraps io.ErrUnexpectedEOF and
+// locates the block that was cut short. Data after the last stream that
+// does not start another is counted as TrailingGarbage rather than failing
+// the check.
+func Verify(r io.Reader) (*VerifyResult, error) {
+	res := &VerifyResult{}
+	var bz bzip
+	if err := bz.decompressInit(0, 0, nil, 0); err != nil {
+		return res, err
+	}
+	defer func() { bz.endDecompress() }()
+
+	in := make([]byte, verifyBufferLen)
+	out := make([]byte, verifyBufferLen)
+
+	var prevIn int64
+	streamEnd := false
+	// place moves e from the current stream to the whole input, counting
+	// what was checked of the stream up to the block that failed
+	place := func(e *Error) *Error {
+		blocks := bz.blocks()
+		if e.Block > 0 {
+			blocks = e.Block - 1
+			e.Block += res.Blocks
+		}
+		res.Blocks += blocks
+		res.Size += e.UncompressedOffset
+		e.CompressedOffset += prevIn
+		e.UncompressedOffset = res.Size
+		return e
+	}
+	for {
+		if bz.availIn() == 0 {
+			n, err := io.ReadFull(r, in)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return res, err
+			}
+			if n == 0 {
+				if !streamEnd {
+					// locate it like a decoding error, in the block
+					// that was cut short
+					e := bz.decompressError(BZ_UNEXPECTED_EOF, 0).(*Error)
+					e.Err = io.ErrUnexpectedEOF
+					return res, place(e)
+				}
+				return res, nil
+			}
+			bz.setInBuf(in, n)
+		}
+		// more input after the end of a stream is the next one
+		if streamEnd {
+			prevIn += bz.totalIn()
+			if err := bz.restartDecompress(0, 0); err != nil {
+				return res, err
+			}
+			streamEnd = false
+		}
+		bz.setOutBuf(out, len(out))
+		ret, err := bz.decompress()
+		if errors.Is(err, ErrBadMagic) && res.Streams > 0 {
+			// count the rest of the input, which ends the check
+			rest, err := io.Copy(io.Discard, r)
+			res.TrailingGarbage = bz.totalIn() + int64(bz.availIn()) + rest
+			return res, err
+		}
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				err = place(e)
+			}
+			return res, err
+		}
+		if ret == BZ_STREAM_END {
+			streamEnd = true
+			res.Streams++
+			res.Blocks += bz.blocks()
+			res.Size += bz.totalOut()
+		}
+	}
+}
+
+// VerifyParallel is like Verify, but checks the size bytes of r with the
+// blocks decoded concurrently, as by ParallelReader. The error for corrupt
+// data is the first in input order.
+func VerifyParallel(r io.ReaderAt, size int64, opts *ParallelReaderOptions) (*VerifyResult, error) {
+	pr, err := NewParallelReader(io.NewSectionReader(r, 0, size), opts)
+	if err != nil {
+		return &VerifyResult{}, err
+	}
+	defer pr.Close()
+	for {
+		// the decoded blocks are dropped without being copied out
+		if err := pr.advance(); err != nil {
+			res := &VerifyResult{Streams: pr.streams, Blocks: pr.blocks, Size: pr.total}
+			if errors.Is(err, ErrBadMagic) && pr.streams > 0 {
+				res.TrailingGarbage = size - pr.in
+				err = nil
+			}
+			if err == io.EOF {
+				err = nil
+				if pr.streams == 0 {
+					err = &Error{Op: opDecompress, Code: BZ_UNEXPECTED_EOF, Err: io.ErrUnexpectedEOF}
+				}
+			}
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package cbzip2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	raw, compressed := multiBlock(t)
+	idx, err := BuildIndex(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("error building index: %s", err)
+	}
+	two := append(append([]byte{}, compressed...), compressed...)
+	blk := idx.Blocks[2]
+	bit := blk.CompressedOffset + 48 + 5
+	badCRC := append([]byte{}, two...)
+	badCRC[len(compressed)+int(bit/8)] ^= 0x80 >> (bit % 8)
+
+	n := len(idx.Blocks)
+	last := idx.Blocks[n-1]
+	tt := []struct {
+		msg     string
+		data    []byte
+		want    VerifyResult
+		wantErr error
+		block   int
+		in      int64
+	}{
+		{msg: "intact", data: two, want: VerifyResult{Streams: 2, Blocks: 2 * n, Size: 2 * int64(len(raw))}},
+		{
+			msg: "bad crc in second stream", data: badCRC, wantErr: ErrBadData, block: n + 3,
+			in:   int64(len(compressed)) + blk.CompressedOffset/8,
+			want: VerifyResult{Streams: 1, Blocks: n + 2, Size: int64(len(raw)) + blk.UncompressedOffset},
+		},
+		{
+			msg: "truncated", data: compressed[:len(compressed)-10], wantErr: io.ErrUnexpectedEOF, block: n,
+			in:   last.CompressedOffset / 8,
+			want: VerifyResult{Blocks: n - 1, Size: last.UncompressedOffset},
+		},
+		{msg: "empty", data: nil, wantErr: io.ErrUnexpectedEOF},
+		{
+			msg: "trailing garbage", data: append(append([]byte{}, two...), make([]byte, 100)...),
+			want: VerifyResult{Streams: 2, Blocks: 2 * n, Size: 2 * int64(len(raw)), TrailingGarbage: 100},
+		},
+		// longer than a block can be, so the last stream ends before the
+		// input does
+		{
+			msg: "long trailing garbage", data: append(append([]byte{}, compressed...), make([]byte, 300*1024)...),
+			want: VerifyResult{Streams: 1, Blocks: n, Size: int64(len(raw)), TrailingGarbage: 300 * 1024},
+		},
+		{msg: "only garbage", data: make([]byte, 100), wantErr: ErrBadMagic},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		res, err := Verify(bytes.NewReader(v.data))
+		if !errors.Is(err, v.wantErr) {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, err)
+		}
+		if !reflect.DeepEqual(*res, v.want) {
+			t.Fatalf("wanted %+v, got %+v", v.want, *res)
+		}
+		var e *Error
+		if v.block > 0 && (!errors.As(err, &e) || e.Block != v.block || e.CompressedOffset != v.in || e.UncompressedOffset != v.want.Size) {
+			t.Fatalf("wanted an error in block %d, got: %v", v.block, err)
+		}
+
+		pres, perr := VerifyParallel(bytes.NewReader(v.data), int64(len(v.data)), nil)
+		if !errors.Is(perr, v.wantErr) {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, perr)
+		}
+		if !reflect.DeepEqual(pres, res) {
+			t.Fatalf("wanted %+v, got %+v", *res, *pres)
+		}
+		if v.block > 0 && (!errors.As(perr, &e) || e.Block != v.block || e.CompressedOffset != v.in || e.UncompressedOffset != v.want.Size) {
+			t.Fatalf("wanted an error in block %d, got: %v", v.block, perr)
+		}
+	}
+}
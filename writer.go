@@ -1,12 +1,81 @@
 package cbzip2
 
-import "io"
+import (
+	"io"
+	"runtime"
+)
 
 type Writer struct {
-	w   io.Writer
-	bz  bzip
-	out []byte
-	err error
+	w    io.Writer
+	bz   bzip
+	opts WriterOptions
+	out  []byte
+	// index records the blocks written, if enabled
+	index *indexRecorder
+	state streamState
+	guard useGuard
+	// copyBuf is the input buffer of ReadFrom, kept for the next call
+	copyBuf []byte
+	err     error
+}
+
+// WriterOptions controls the parameters handed to BZ2_bzCompressInit.
+// The zero value uses the library defaults.
+type WriterOptions struct {
+	// BlockSize is the block size in units of 100k, between 1 and 9.
+	// 0 selects the default of 9.
+	BlockSize int
+	// WorkFactor controls how much effort the standard sorting algorithm
+	// spends on repetitive input before switching to the fallback, between
+	// 0 and 250. 0 selects the default of 30.
+	WorkFactor int
+	// Verbosity is the libbzip2 trace level, between 0 (silent) and 4.
+	Verbosity int
+	// Log receives the trace output requested by Verbosity. If nil, it
+	// goes to the process's stderr.
+	Log io.Writer
+	// BuildIndex records the position of every block as it is written,
+	// see Writer.Index.
+	BuildIndex bool
+	// IndexWriter, if set, receives the index of the stream in the format
+	// of Index.MarshalBinary when the writer is closed. It implies
+	// BuildIndex.
+	IndexWriter io.Writer
+	// MemoryBudget, if positive, is the most memory libbzip2 may allocate
+	// for the stream, which is about 400k + 8 x the block size. Going over
+	// it fails the writer's creation with ErrMem. See also SetMemoryLimit.
+	MemoryBudget int64
+	// PanicOnConcurrentUse makes a call that overlaps another on the same
+	// Writer panic, rather than return ErrConcurrentUse.
+	PanicOnConcurrentUse bool
+}
+
+func (o *WriterOptions) validate() error {
+	if o.BlockSize < 0 || o.BlockSize > 9 {
+		return ErrBlockSize
+	}
+	if o.WorkFactor < 0 || o.WorkFactor > maxWorkFactor {
+		return ErrWorkFactor
+	}
+	// BZ2_bzCompressInit does not check this itself
+	if o.Verbosity < 0 || o.Verbosity > maxVerbosity {
+		return ErrBadParam
+	}
+	return nil
+}
+
+func (o *WriterOptions) blockSize() int {
+	if o.BlockSize == 0 {
+		return blockSize
+	}
+	return o.BlockSize
+}
+
+func (o *WriterOptions) workFactor() int {
+	if o.WorkFactor == 0 {
+		return workFactor
+	}
+	return o.WorkFactor
 }
 
 // NewWriter returns an io.WriteCloser. Writes to this writer are
@@ -14,18 +83,133 @@ type Writer struct {
 // It is the caller's responsibility to call Close on the WriteCloser.
 // Writes may not be flushed until Close.
 func NewWriter(w io.Writer) (*Writer, error) {
-	wrtr := &Writer{w: w, out: make([]byte, bufferLen)}
+	return NewWriterOptions(w, nil)
+}
 
-	if err := wrtr.bz.compressInit(blockSize, verbosity, workFactor); err != nil {
+// NewWriterLevel is like NewWriter but specifies the compression level,
+// which is either DefaultCompression or an integer between BestSpeed and
+// BestCompression inclusive. The level is used as the bzip2 block size.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	if level == DefaultCompression {
+		return NewWriterOptions(w, nil)
+	}
+	if level < BestSpeed || level > BestCompression {
+		return nil, ErrBlockSize
+	}
+	return NewWriterOptions(w, &WriterOptions{BlockSize: level})
+}
+
+// NewWriterOptions is like NewWriter but compresses with the given options.
+// A nil opts is equivalent to the zero WriterOptions.
+func NewWriterOptions(w io.Writer, opts *WriterOptions) (*Writer, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	wrtr := &Writer{w: w, opts: *opts, out: make([]byte, bufferLen)}
+
+	if err := wrtr.init(); err != nil {
 		return nil, err
 	}
+	runtime.SetFinalizer(wrtr, (*Writer).finalize)
 
 	return wrtr, nil
 }
 
+// finalize frees the stream of a Writer that was never closed. The data
+// it held is lost.
+func (b *Writer) finalize() {
+	if b.bz.active() {
+		logLeak("Writer")
+		_ = b.bz.endCompress()
+	}
+}
+
+func (b *Writer) init() error {
+	b.index = nil
+	if b.opts.BuildIndex || b.opts.IndexWriter != nil {
+		b.index = &indexRecorder{}
+	}
+	hooks := newStreamHooks(b.opts.Log, b.index)
+	return b.bz.compressInit(b.opts.blockSize(), b.opts.Verbosity, b.opts.workFactor(), hooks, b.opts.MemoryBudget)
+}
+
+// Reset discards the writer's state and makes it equivalent to the result
+// of its original constructor, but writing to w instead. Any data not yet
+// written by Close is lost. Only the Go buffers are reused: libbzip2 has no
+// way to reset a stream, so its state is freed and allocated again.
+func (b *Writer) Reset(w io.Writer) {
+	_ = b.bz.endCompress()
+	b.w = w
+	b.state = stateOpen
+	if b.err = b.init(); b.err != nil {
+		b.state = stateErrored
+	}
+	// drop whatever input was left over from the previous stream
+	b.bz.setInBuf(nil, 0)
+}
+
+// TotalIn returns the number of uncompressed bytes consumed so far.
+func (b *Writer) TotalIn() int64 {
+	return b.bz.totalIn()
+}
+
+// TotalOut returns the number of compressed bytes produced so far. Output
+// held by the compressor is not counted until Flush or Close.
+func (b *Writer) TotalOut() int64 {
+	return b.bz.totalOut()
+}
+
+// MemoryInUse returns the number of bytes libbzip2 currently has allocated
+// for the writer.
+func (b *Writer) MemoryInUse() int64 {
+	return b.bz.memory()
+}
+
+// CompressionRatio returns TotalIn / TotalOut, or 0 if nothing has been
+// produced yet.
+func (b *Writer) CompressionRatio() float64 {
+	return ratio(b.TotalIn(), b.TotalOut())
+}
+
+// Index returns the blocks written so far, if the writer was created with
+// BuildIndex or IndexWriter set, and nil otherwise. A block is only added
+// once its end is known, so the index is complete after Close.
+func (b *Writer) Index() *Index {
+	if b.index == nil {
+		return nil
+	}
+	idx := b.index.idx
+	return &idx
+}
+
+// Err returns the error that stopped the writer, nil while it can still
+// be written to, and ErrClosed once it has been closed. After a failure,
+// TotalIn is the amount of input that went into the compressor.
+func (b *Writer) Err() error {
+	return b.err
+}
+
 // Write writes a compressed p to an underlying io.Writer. The bytes are not
-// necessarily flushed until the writer is closed or Flush is called.
+// necessarily flushed until the writer is closed or Flush is called. Once
+// a call has failed, every other returns the same error, and ErrClosed
+// after Close. On failure, the count returned is the part of d that the
+// compressor had already taken in, see Err.
+//
+// A Writer is not safe for concurrent use: a Write, ReadFrom, Flush or
+// Close that overlaps another fails with ErrConcurrentUse.
 func (b *Writer) Write(d []byte) (int, error) {
+	if err := b.guard.enter("Writer", b.opts.PanicOnConcurrentUse); err != nil {
+		return 0, err
+	}
+	defer b.guard.exit()
+	return b.write(d)
+}
+
+// write is Write, without the guard.
+func (b *Writer) write(d []byte) (int, error) {
 	if b.err != nil {
 		return 0, b.err
 	}
@@ -35,8 +219,9 @@ func (b *Writer) Write(d []byte) (int, error) {
 	for {
 		_, err := b.compress(BZ_RUN)
 		if err != nil {
-			b.err = err
-			return 0, b.err
+			// the rest of d was never handed to the compressor
+			n := len(d) - b.bz.availIn()
+			return n, b.fail(err)
 		}
 		// if we've processed all of the input, break
 		if b.bz.availIn() == 0 {
@@ -48,14 +233,17 @@ func (b *Writer) Write(d []byte) (int, error) {
 
 // Flush writes any pending data to the underlying writer.
 func (b *Writer) Flush() error {
+	if err := b.guard.enter("Writer", b.opts.PanicOnConcurrentUse); err != nil {
+		return err
+	}
+	defer b.guard.exit()
 	if b.err != nil {
 		return b.err
 	}
 	for {
 		ret, err := b.compress(BZ_FLUSH)
 		if err != nil {
-			b.err = err
-			return b.err
+			return b.fail(err)
 		}
 		// if we're done flushing, return
 		if ret == BZ_RUN_OK {
@@ -66,16 +254,27 @@ func (b *Writer) Flush() error {
 }
 
 // Close closes the writer, flushing any unwritten data to the underlying io.Writer
-// Close does not close the underlying io.Writer.
+// Close does not close the underlying io.Writer. It returns the error that
+// stopped the writer, if any, and ErrClosed if it is already closed.
 func (b *Writer) Close() error {
-	if b.err != nil {
-		return b.err
+	if err := b.guard.enter("Writer", b.opts.PanicOnConcurrentUse); err != nil {
+		return err
+	}
+	defer b.guard.exit()
+	switch b.state {
+	case stateClosed:
+		return ErrClosed
+	case stateErrored:
+		err := b.err
+		b.close()
+		return err
 	}
 	for {
 		ret, err := b.compress(BZ_FINISH)
 		if err != nil {
-			b.err = err
-			return b.err
+			b.fail(err)
+			b.close()
+			return err
 		}
 		// When we get to the actual end of the stream, break
 		if ret == BZ_STREAM_END {
@@ -83,8 +282,14 @@ func (b *Writer) Close() error {
 		}
 	}
 
-	_ = b.bz.endCompress()
-	b.err = io.EOF
+	b.close()
+	if b.opts.IndexWriter != nil {
+		// MarshalBinary can't fail
+		data, _ := b.index.idx.MarshalBinary()
+		if _, err := b.opts.IndexWriter.Write(data); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -100,11 +305,29 @@ func (b *Writer) compress(flag int) (int, error) {
 
 	// we have (total length) - (space available) of data
 	have := len(b.out) - b.bz.availOut()
-	_, err = b.w.Write(b.out[:have])
+	n, err := b.w.Write(b.out[:have])
+	if err == nil && n < have {
+		err = io.ErrShortWrite
+	}
 	if err != nil {
-		_ = b.bz.endCompress()
 		return 0, err
 	}
 
 	return int(ret), nil
 }
+
+// fail stops the writer with err, releasing the stream.
+func (b *Writer) fail(err error) error {
+	b.err = err
+	b.state = stateErrored
+	_ = b.bz.endCompress()
+	return err
+}
+
+// close releases the stream, if it is still held, and marks the writer
+// closed.
+func (b *Writer) close() {
+	_ = b.bz.endCompress()
+	b.state = stateClosed
+	b.err = ErrClosed
+}
@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"crypto/rand"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"unsafe"
 )
 
 func TestBasicCompress(t *testing.T) {
@@ -77,3 +82,332 @@ func TestRandomCompress(t *testing.T) {
 		t.Fatal("data passed through cbzip2 did not match after decompression")
 	}
 }
+
+func TestWriterLevel(t *testing.T) {
+	for level := BestSpeed; level <= BestCompression; level++ {
+		var out bytes.Buffer
+		wrtr, err := NewWriterLevel(&out, level)
+		if err != nil {
+			t.Fatalf("error creating bzip writer with level %d: %s", level, err)
+		}
+		if _, err := wrtr.Write([]byte("hello, world")); err != nil {
+			t.Fatalf("error writing data: %s", err)
+		}
+		if err := wrtr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+		if got, want := out.Bytes()[3], byte('0'+level); got != want {
+			t.Fatalf("level %d: wanted block size header %q, got %q", level, want, got)
+		}
+	}
+}
+
+func TestWriterOptionsValidation(t *testing.T) {
+	tt := []struct {
+		msg     string
+		opts    *WriterOptions
+		wantErr error
+	}{
+		{msg: "nil options", opts: nil},
+		{msg: "zero options", opts: &WriterOptions{}},
+		{msg: "smallest block", opts: &WriterOptions{BlockSize: 1, WorkFactor: 250}},
+		{msg: "block too large", opts: &WriterOptions{BlockSize: 10}, wantErr: ErrBlockSize},
+		{msg: "negative block", opts: &WriterOptions{BlockSize: -1}, wantErr: ErrBlockSize},
+		{msg: "work factor too large", opts: &WriterOptions{WorkFactor: 251}, wantErr: ErrWorkFactor},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		_, err := NewWriterOptions(new(bytes.Buffer), v.opts)
+		if err != v.wantErr {
+			t.Fatalf("wanted err: %v, got: %v", v.wantErr, err)
+		}
+		if v.wantErr != nil && !errors.Is(err, ErrBadParam) {
+			t.Fatalf("wanted err: %v, got: %v", ErrBadParam, err)
+		}
+	}
+	if _, err := NewWriterLevel(new(bytes.Buffer), 0); err != ErrBlockSize {
+		t.Fatalf("wanted err: %v, got: %v", ErrBlockSize, err)
+	}
+}
+
+func TestWriterLog(t *testing.T) {
+	var log, out bytes.Buffer
+	wrtr, err := NewWriterOptions(&out, &WriterOptions{Verbosity: 2, Log: &log})
+	if err != nil {
+		t.Fatalf("error creating bzip writer: %s", err)
+	}
+	if _, err := wrtr.Write(bytes.Repeat([]byte("hello, world "), 1024)); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	if !bytes.Contains(log.Bytes(), []byte("block 1: crc = 0x")) {
+		t.Fatalf("expected block trace in log output, got: %q", log.String())
+	}
+	if _, err := NewWriterOptions(&out, &WriterOptions{Verbosity: 5}); err != ErrBadParam {
+		t.Fatalf("wanted err: %v, got: %v", ErrBadParam, err)
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	var first, second bytes.Buffer
+	wrtr, err := NewWriterLevel(&first, BestSpeed)
+	if err != nil {
+		t.Fatalf("error creating bzip writer: %s", err)
+	}
+	if _, err := wrtr.Write([]byte("abandoned")); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	// reset before Close, the first stream is discarded
+	wrtr.Reset(&second)
+	for i := 0; i < 2; i++ {
+		if _, err := wrtr.Write([]byte("hello, world")); err != nil {
+			t.Fatalf("error writing data: %s", err)
+		}
+		if err := wrtr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+		if got := second.Bytes()[3]; got != '1' {
+			t.Fatalf("reset writer did not keep its level, got block size %q", got)
+		}
+		var decompress bytes.Buffer
+		if _, err := io.Copy(&decompress, bzip2.NewReader(&second)); err != nil {
+			t.Fatalf("error decompressing data with builtin bzip2: %s", err)
+		}
+		if decompress.String() != "hello, world" {
+			t.Fatalf("reset writer produced %q", decompress.String())
+		}
+		second.Reset()
+		wrtr.Reset(&second)
+	}
+}
+
+func TestWriterTotals(t *testing.T) {
+	var out bytes.Buffer
+	wrtr, err := NewWriter(&out)
+	if err != nil {
+		t.Fatalf("error creating bzip writer: %s", err)
+	}
+	data := bytes.Repeat([]byte("hello, world "), 4096)
+	if _, err := wrtr.Write(data); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	if got := wrtr.TotalIn(); got != int64(len(data)) {
+		t.Fatalf("wanted TotalIn %d, got %d", len(data), got)
+	}
+	if got := wrtr.TotalOut(); got != int64(out.Len()) {
+		t.Fatalf("wanted TotalOut %d, got %d", out.Len(), got)
+	}
+	if got, want := wrtr.CompressionRatio(), float64(len(data))/float64(out.Len()); got != want {
+		t.Fatalf("wanted CompressionRatio %f, got %f", want, got)
+	}
+}
+
+// failWriter fails every write after the first n bytes.
+type failWriter struct {
+	n   int
+	err error
+}
+
+func (fw *failWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		n := fw.n
+		fw.n = 0
+		return n, fw.err
+	}
+	fw.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriterLifecycle(t *testing.T) {
+	wrtr, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Fatalf("error creating bzip writer: %s", err)
+	}
+	if err := wrtr.Close(); err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	if wrtr.MemoryInUse() != 0 {
+		t.Fatalf("memory still in use after Close: %d", wrtr.MemoryInUse())
+	}
+	if _, err := wrtr.Write([]byte("hello")); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+	if err := wrtr.Flush(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+	if err := wrtr.Close(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+
+	// a failed write releases the stream, and is reported again by Close
+	fail := errors.New("disk full")
+	wrtr.Reset(&failWriter{err: fail})
+	if _, err := wrtr.Write([]byte("hello")); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	if err := wrtr.Flush(); err != fail {
+		t.Fatalf("wanted err: %v, got: %v", fail, err)
+	}
+	if wrtr.MemoryInUse() != 0 {
+		t.Fatalf("memory still in use after failure: %d", wrtr.MemoryInUse())
+	}
+	if _, err := wrtr.Write([]byte("hello")); err != fail {
+		t.Fatalf("wanted err: %v, got: %v", fail, err)
+	}
+	if err := wrtr.Close(); err != fail {
+		t.Fatalf("wanted err: %v, got: %v", fail, err)
+	}
+	if err := wrtr.Close(); err != ErrClosed {
+		t.Fatalf("wanted err: %v, got: %v", ErrClosed, err)
+	}
+}
+
+// blockingWriter holds up its first non-empty Write until release is
+// closed, closing entered once it has been called.
+type blockingWriter struct {
+	w       io.Writer
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	bw.once.Do(func() {
+		close(bw.entered)
+		<-bw.release
+	})
+	return bw.w.Write(p)
+}
+
+func TestWriterConcurrentUse(t *testing.T) {
+	var out bytes.Buffer
+	bw := &blockingWriter{w: &out, entered: make(chan struct{}), release: make(chan struct{})}
+	wrtr, err := NewWriter(bw)
+	if err != nil {
+		t.Fatalf("error creating bzip writer: %s", err)
+	}
+	if _, err := wrtr.Write([]byte("hello, world")); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+	done := make(chan error)
+	go func() { done <- wrtr.Close() }()
+	<-bw.entered
+	if _, err := wrtr.Write([]byte("hello")); err != ErrConcurrentUse {
+		t.Fatalf("wanted err: %v, got: %v", ErrConcurrentUse, err)
+	}
+	if err := wrtr.Flush(); err != ErrConcurrentUse {
+		t.Fatalf("wanted err: %v, got: %v", ErrConcurrentUse, err)
+	}
+	close(bw.release)
+	// the call already running is unaffected
+	if err := <-done; err != nil {
+		t.Fatalf("failed to close bzip2 writer: %s", err)
+	}
+	if got, err := Decompress(nil, out.Bytes()); err != nil || string(got) != "hello, world" {
+		t.Fatalf("writer produced %q, err: %v", got, err)
+	}
+}
+
+// shortWriter accepts only half of every write, without an error.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	return len(p) / 2, nil
+}
+
+func TestWriterPartialWrite(t *testing.T) {
+	data := make([]byte, 300*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("error generating random data: %s", err)
+	}
+	fail := errors.New("connection reset")
+	tt := []struct {
+		msg string
+		w   io.Writer
+		err error
+	}{
+		{msg: "failed write", w: &failWriter{n: 1000, err: fail}, err: fail},
+		{msg: "short write", w: shortWriter{}, err: io.ErrShortWrite},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		wrtr, err := NewWriterOptions(v.w, &WriterOptions{BlockSize: 1})
+		if err != nil {
+			t.Fatalf("error creating bzip writer: %s", err)
+		}
+		if wrtr.Err() != nil {
+			t.Fatalf("wanted no error on a new writer, got: %v", wrtr.Err())
+		}
+		// the first block is written out part way through the data
+		n, err := wrtr.Write(data)
+		if err != v.err {
+			t.Fatalf("wanted err: %v, got: %v", v.err, err)
+		}
+		if n == 0 || n == len(data) || int64(n) != wrtr.TotalIn() {
+			t.Fatalf("wrote %d of %d bytes, TotalIn %d", n, len(data), wrtr.TotalIn())
+		}
+		if wrtr.Err() != v.err {
+			t.Fatalf("wanted err: %v, got: %v", v.err, wrtr.Err())
+		}
+		if err := wrtr.Close(); err != v.err {
+			t.Fatalf("wanted err: %v, got: %v", v.err, err)
+		}
+		if wrtr.Err() != ErrClosed {
+			t.Fatalf("wanted err: %v, got: %v", ErrClosed, wrtr.Err())
+		}
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	raw, _ := multiBlock(t)
+	path := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening file: %s", err)
+	}
+	defer f.Close()
+	tt := []struct {
+		msg string
+		r   io.Reader
+	}{
+		// a reader that is not a file
+		{msg: "reader", r: io.MultiReader(bytes.NewReader(raw))},
+		{msg: "file", r: f},
+	}
+	for _, v := range tt {
+		t.Logf("test: %s", v.msg)
+		var out bytes.Buffer
+		wrtr, err := NewWriter(&out)
+		if err != nil {
+			t.Fatalf("error creating bzip writer: %s", err)
+		}
+		n, err := wrtr.ReadFrom(v.r)
+		if err != nil {
+			t.Fatalf("error compressing data: %s", err)
+		}
+		if n != int64(len(raw)) || n != wrtr.TotalIn() {
+			t.Fatalf("wanted %d bytes, got %d, TotalIn %d", len(raw), n, wrtr.TotalIn())
+		}
+		if err := wrtr.Close(); err != nil {
+			t.Fatalf("failed to close bzip2 writer: %s", err)
+		}
+		if got, err := Decompress(nil, out.Bytes()); err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("round trip failed, err: %v", err)
+		}
+	}
+
+	if buf := copyBuffer(nil, f); len(buf) != fileBufferLen || uintptr(unsafe.Pointer(&buf[0]))%uintptr(os.Getpagesize()) != 0 {
+		t.Fatalf("wanted a %d byte page aligned buffer for a file, got %d bytes at %p", fileBufferLen, len(buf), &buf[0])
+	}
+}